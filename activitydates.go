@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Submissions record the day of the temple visit as well as when they were
+// entered, so a batch entered days later still counts for the day it was
+// done. Activity dates are kept as YYYY-MM-DD in the server's time zone.
+
+const (
+	competitionDatesSetting = "competition_dates"
+	activityDateLayout      = "2006-01-02"
+	maxBackdateDays         = 365
+)
+
+// CompetitionDates bounds the activity dates submissions may claim. Start
+// and end are inclusive, and either may be empty for no limit.
+type CompetitionDates struct {
+	StartDate    string `json:"start_date"`
+	EndDate      string `json:"end_date"`
+	BackdateDays int    `json:"backdate_days"` // how far before today a visit may be
+}
+
+// defaultCompetitionDates are used until an admin sets the competition's dates.
+var defaultCompetitionDates = CompetitionDates{BackdateDays: 14}
+
+func today() string {
+	return time.Now().Format(activityDateLayout)
+}
+
+func (s *Server) competitionDates() CompetitionDates {
+	value, err := getSetting(s.db, competitionDatesSetting)
+	if err != nil {
+		return defaultCompetitionDates
+	}
+
+	var dates CompetitionDates
+	if err := json.Unmarshal([]byte(value), &dates); err != nil {
+		log.Printf("Error reading competition dates: %v", err)
+		return defaultCompetitionDates
+	}
+	return dates
+}
+
+// window returns the earliest and latest activity dates a submission made
+// today may claim. earliest is after latest once the competition is over.
+func (c CompetitionDates) window() (earliest, latest string) {
+	now := time.Now()
+	earliest = now.AddDate(0, 0, -c.BackdateDays).Format(activityDateLayout)
+	latest = now.Format(activityDateLayout)
+
+	// Dates in this layout compare correctly as strings
+	if c.StartDate > earliest {
+		earliest = c.StartDate
+	}
+	if c.EndDate != "" && c.EndDate < latest {
+		latest = c.EndDate
+	}
+	return earliest, latest
+}
+
+// checkActivityDate returns the activity date to record for date, which is
+// today if it's empty, or why it can't be used.
+func (c CompetitionDates) checkActivityDate(date string) (string, error) {
+	if date == "" {
+		date = today()
+	}
+	if _, err := time.Parse(activityDateLayout, date); err != nil {
+		return "", fmt.Errorf("use YYYY-MM-DD")
+	}
+
+	earliest, latest := c.window()
+	switch {
+	case c.EndDate != "" && date > c.EndDate:
+		return "", fmt.Errorf("the competition ended on %s", c.EndDate)
+	case date > latest:
+		return "", fmt.Errorf("activity date can't be in the future")
+	case date < c.StartDate:
+		return "", fmt.Errorf("the competition started on %s", c.StartDate)
+	case date < earliest:
+		return "", fmt.Errorf("visits can be submitted up to %d days afterwards", c.BackdateDays)
+	}
+	return date, nil
+}
+
+// View the competition dates and the activity dates submissions may
+// currently claim, or change them (admin only)
+func (s *Server) handleCompetitionDates(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		userID := s.getUserIDFromSession(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !s.isAdmin(userID) {
+			http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+			return
+		}
+
+		var req CompetitionDates
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		for _, date := range []string{req.StartDate, req.EndDate} {
+			if _, err := time.Parse(activityDateLayout, date); date != "" && err != nil {
+				http.Error(w, "Dates must be given as YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.StartDate != "" && req.EndDate != "" && req.EndDate < req.StartDate {
+			http.Error(w, "The competition can't end before it starts", http.StatusBadRequest)
+			return
+		}
+		if req.BackdateDays < 0 || req.BackdateDays > maxBackdateDays {
+			http.Error(w, fmt.Sprintf("Back-dating must be between 0 and %d days", maxBackdateDays),
+				http.StatusBadRequest)
+			return
+		}
+
+		value, _ := json.Marshal(req)
+		if err := setSetting(s.db, competitionDatesSetting, string(value)); err != nil {
+			log.Printf("Error saving competition dates: %v", err)
+			http.Error(w, "Failed to save competition dates", http.StatusInternalServerError)
+			return
+		}
+
+		s.logActivity(0, &userID, "competition_dates_changed",
+			fmt.Sprintf("Competition dates set to %s to %s, with visits accepted up to %d days afterwards",
+				orOpen(req.StartDate), orOpen(req.EndDate), req.BackdateDays), 0)
+	}
+
+	dates := s.competitionDates()
+	earliest, latest := dates.window()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"start_date":    dates.StartDate,
+		"end_date":      dates.EndDate,
+		"backdate_days": dates.BackdateDays,
+		"earliest":      earliest,
+		"latest":        latest,
+	})
+}
+
+func orOpen(date string) string {
+	if date == "" {
+		return "(open)"
+	}
+	return date
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckActivityDate(t *testing.T) {
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(activityDateLayout)
+	}
+
+	open := defaultCompetitionDates
+	running := CompetitionDates{StartDate: day(-3), EndDate: day(10), BackdateDays: 14}
+	ended := CompetitionDates{StartDate: day(-30), EndDate: day(-5), BackdateDays: 14}
+
+	tests := []struct {
+		name    string
+		dates   CompetitionDates
+		date    string
+		want    string
+		wantErr bool
+	}{
+		{"empty means today", open, "", day(0), false},
+		{"today", open, day(0), day(0), false},
+		{"within the backdate window", open, day(-14), day(-14), false},
+		{"before the backdate window", open, day(-15), "", true},
+		{"tomorrow", open, day(1), "", true},
+		{"not a date", open, "yesterday", "", true},
+		{"wrong layout", open, time.Now().Format("01/02/2006"), "", true},
+		{"on the start date", running, day(-3), day(-3), false},
+		{"before the start date", running, day(-4), "", true},
+		{"after the competition ended", ended, day(-4), "", true},
+		{"last day of an ended competition", ended, day(-5), day(-5), false},
+		{"empty after the competition ended", ended, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.dates.checkActivityDate(tt.date)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("checkActivityDate(%q) = %q, %v; want %q, error %v", tt.date, got, err, tt.want,
+					tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreakCountsApprovedVisitsInTheLastWeek(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+
+	result, err := s.db.Exec(`INSERT INTO wards (name) VALUES ('Streak Ward')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	wardID := int(id)
+
+	visit := func(offset int, action string) {
+		t.Helper()
+		rec := newTestClient(t, s).do("POST", "/api/points", map[string]interface{}{
+			"ward_id":        wardID,
+			"submitter_name": "Test Member",
+			"activity_date":  time.Now().AddDate(0, 0, offset).Format(activityDateLayout),
+			"items":          []SubmissionItem{{Category: "baptism", Quantity: 1}},
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("submitting: %d %s", rec.Code, rec.Body.String())
+		}
+		var sub submitted
+		decodeJSON(t, rec, &sub)
+
+		switch action {
+		case "approve":
+			rec = admin.do("POST", pointsPath(sub.ID, "approve"), nil)
+		case "reject":
+			rec = admin.do("POST", pointsPath(sub.ID, "reject"), map[string]interface{}{"reason": "Duplicate"})
+		case "ask":
+			rec = admin.do("POST", pointsPath(sub.ID, "comments"), map[string]interface{}{"body": "Which temple?", "needs_info": true})
+		default:
+			return
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", action, rec.Code, rec.Body.String())
+		}
+	}
+
+	visit(0, "approve")
+	visit(0, "approve")
+	visit(-6, "approve")
+	visit(-7, "approve") // a week ago, so outside the last week
+	visit(-1, "")        // not reviewed yet
+	visit(-2, "reject")  // turned down
+	visit(-3, "ask")     // waiting on the submitter
+
+	if got := s.calculateStreak(wardID); got != 2 {
+		t.Errorf("streak = %d, want 2", got)
+	}
+}
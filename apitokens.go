@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Prefix on every API token so they're easy to spot in scripts and logs
+	apiTokenPrefix = "tp_"
+
+	maxAPITokenDays = 365
+)
+
+// apiTokenScopes lists the permissions a token can be limited to. Managing
+// users is deliberately left out; that needs a signed-in browser.
+var apiTokenScopes = []string{
+	permReadLeaderboard, permViewSubmissions, permApproveSubmissions, permCreateSubmissions,
+}
+
+type contextKey string
+
+// apiTokenUserKey holds the user ID of a request authenticated by API token.
+const apiTokenUserKey contextKey = "api_token_user"
+
+func isAPITokenScope(scope string) bool {
+	for _, s := range apiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// errTokenNeedsTwoFactor means the token's owner is in a role that requires
+// 2FA but hasn't enrolled, so the token can't be used until they do.
+var errTokenNeedsTwoFactor = errors.New("two-factor authentication setup required")
+
+// lookupAPIToken resolves a raw token to its unexpired record, provided the
+// owner's account is enabled, and notes that it was used. Tokens of owners
+// who must enroll in 2FA but haven't return errTokenNeedsTwoFactor.
+func (s *Server) lookupAPIToken(raw string) (*APIToken, error) {
+	var token APIToken
+	var scopes, role string
+	var totpEnabled bool
+	err := s.db.QueryRow(`
+		SELECT t.id, t.user_id, t.name, t.scopes, u.role, u.totp_enabled
+		FROM api_tokens t
+		JOIN users u ON t.user_id = u.id
+		WHERE t.token_hash = ? AND u.disabled = 0
+		AND (t.expires_at IS NULL OR t.expires_at > CURRENT_TIMESTAMP)
+	`, hashToken(raw)).Scan(&token.ID, &token.UserID, &token.Name, &scopes, &role, &totpEnabled)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+
+	if !totpEnabled && s.twoFactorRequired(role) {
+		return nil, errTokenNeedsTwoFactor
+	}
+
+	// Like sessions, only record use once a minute
+	_, err = s.db.Exec(`
+		UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < datetime('now', '-1 minute'))
+	`, token.ID)
+	if err != nil {
+		log.Printf("Error updating API token last used: %v", err)
+	}
+
+	return &token, nil
+}
+
+func (t *APIToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// withTokenScope lets a route be called with an API token carrying scope.
+// The token's owner is then seen by getUserIDFromSession exactly as if they
+// had signed in, and their role's permissions still apply. Requests without
+// a Bearer header fall through to the session cookie. Routes not wrapped in
+// withTokenScope ignore API tokens entirely.
+func (s *Server) withTokenScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := bearerToken(r)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		token, err := s.lookupAPIToken(raw)
+		if err == errTokenNeedsTwoFactor {
+			http.Error(w, "Set up two-factor authentication before using this API token", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Error loading API token: %v", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid or expired API token", http.StatusUnauthorized)
+			return
+		}
+
+		if !token.hasScope(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, fmt.Sprintf("API token is missing the %s scope", scope), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiTokenUserKey, token.UserID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// List the current user's API tokens
+func (s *Server) handleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, name, scopes, created_at, last_used_at, expires_at,
+		       COALESCE(expires_at <= CURRENT_TIMESTAMP, 0)
+		FROM api_tokens
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error querying API tokens: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		err := rows.Scan(&token.ID, &token.Name, &scopes, &token.CreatedAt, &token.LastUsedAt,
+			&token.ExpiresAt, &token.Expired)
+		if err != nil {
+			log.Printf("Error scanning API token: %v", err)
+			continue
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tokens":           tokens,
+		"available_scopes": s.grantableScopes(userID),
+	})
+}
+
+// grantableScopes lists the token scopes the user's role allows them to
+// hand out.
+func (s *Server) grantableScopes(userID int) []string {
+	var role string
+	if err := s.db.QueryRow(`SELECT role FROM users WHERE id = ?`, userID).Scan(&role); err != nil {
+		return []string{}
+	}
+
+	scopes := []string{}
+	for _, scope := range apiTokenScopes {
+		if roleHasPermission(role, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// Create an API token for the current user. The token is only ever shown in
+// this response.
+func (s *Server) handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"` // 0 for no expiry
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Scopes) == 0 {
+		http.Error(w, "Name and at least one scope are required", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenDays {
+		http.Error(w, fmt.Sprintf("Expiry must be between 0 and %d days", maxAPITokenDays),
+			http.StatusBadRequest)
+		return
+	}
+
+	// A token can't do more than its owner
+	grantable := s.grantableScopes(userID)
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !isAPITokenScope(scope) {
+			http.Error(w, fmt.Sprintf("Unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+		allowed := false
+		for _, g := range grantable {
+			allowed = allowed || g == scope
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("Your role can't grant the %s scope", scope), http.StatusForbidden)
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	raw, err := generateToken(32)
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	raw = apiTokenPrefix + raw
+
+	// datetime() with a NULL modifier is NULL, i.e. no expiry
+	var expiresIn *string
+	if req.ExpiresInDays > 0 {
+		modifier := fmt.Sprintf("+%d days", req.ExpiresInDays)
+		expiresIn = &modifier
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES (?, ?, ?, ?, datetime('now', ?))
+	`, userID, req.Name, hashToken(raw), strings.Join(scopes, " "), expiresIn)
+	if err != nil {
+		log.Printf("Error creating API token: %v", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	tokenID, _ := result.LastInsertId()
+
+	s.logActivity(s.logWardForUser(userID), &userID, "api_token_created",
+		fmt.Sprintf("Created API token %q (%s)", req.Name, strings.Join(scopes, ", ")), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"id":      tokenID,
+		"token":   raw,
+		"scopes":  scopes,
+		"message": "Copy this token now. It won't be shown again.",
+	})
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// revokeUserAPITokens deletes every API token belonging to the user. It's
+// called wherever sessions are cut off after a possible compromise, since a
+// leaked token would otherwise keep working. It returns how many were removed.
+func revokeUserAPITokens(e execer, userID int) (int64, error) {
+	result, err := e.Exec(`DELETE FROM api_tokens WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Revoke one of the current user's API tokens
+func (s *Server) handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	err = s.db.QueryRow(`
+		SELECT name FROM api_tokens WHERE id = ? AND user_id = ?
+	`, tokenID, userID).Scan(&name)
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, tokenID); err != nil {
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		log.Printf("Error revoking API token: %v", err)
+		return
+	}
+
+	s.logActivity(s.logWardForUser(userID), &userID, "api_token_revoked",
+		fmt.Sprintf("Revoked API token %q", name), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Token revoked",
+	})
+}
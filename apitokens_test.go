@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAPITokenScopes(t *testing.T) {
+	s := newTestServer(t)
+	createTestUser(t, s, "approver@example.org", "ward_approver", 1)
+	approver := newTestClient(t, s)
+	approver.login("approver@example.org", testPassword)
+
+	reader := createAPIToken(t, approver, permReadLeaderboard)
+	approverScript := createAPIToken(t, approver, permApproveSubmissions)
+
+	ward1 := submitPoints(t, s, 1, 2)
+	ward2 := submitPoints(t, s, 2, 2)
+	approve := func(id int) string { return "/api/points/" + strconv.Itoa(id) + "/approve" }
+
+	tests := []struct {
+		name   string
+		client *testClient
+		method string
+		path   string
+		want   int
+	}{
+		{"scope granted", reader, "GET", "/api/leaderboard", http.StatusOK},
+		{"scope not granted", reader, "GET", "/api/submissions", http.StatusForbidden},
+		{"approving with the approve scope", approverScript, "POST", approve(ward1.ID), http.StatusOK},
+		{"approving outside the role's wards", approverScript, "POST", approve(ward2.ID), http.StatusForbidden},
+		{"approving without the approve scope", reader, "POST", approve(ward2.ID), http.StatusForbidden},
+		{"route that doesn't take tokens", approverScript, "GET", "/api/sessions", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := tt.client.do(tt.method, tt.path, nil); rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	rec := reader.do("GET", "/api/submissions", nil)
+	if !strings.Contains(rec.Header().Get("WWW-Authenticate"), `scope="`+permViewSubmissions+`"`) {
+		t.Errorf("WWW-Authenticate = %q", rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestAPITokenCreationLimits(t *testing.T) {
+	s := newTestServer(t)
+	createTestUser(t, s, "clerk@example.org", "clerk", 1)
+	clerk := newTestClient(t, s)
+	clerk.login("clerk@example.org", testPassword)
+
+	tests := []struct {
+		name   string
+		scopes []string
+		want   int
+	}{
+		{"scope the role has", []string{permCreateSubmissions}, http.StatusOK},
+		{"scope the role lacks", []string{permApproveSubmissions}, http.StatusForbidden},
+		{"managing users", []string{permManageUsers}, http.StatusBadRequest},
+		{"no scopes", nil, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := clerk.do("POST", "/api/tokens", map[string]interface{}{"name": "script", "scopes": tt.scopes})
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPITokenRevocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(t *testing.T, s *Server, admin *testClient, userID int)
+	}{
+		{"expired", func(t *testing.T, s *Server, _ *testClient, _ int) {
+			s.db.Exec(`UPDATE api_tokens SET expires_at = datetime('now', '-1 minute')`)
+		}},
+		{"account disabled", func(t *testing.T, s *Server, admin *testClient, userID int) {
+			if rec := admin.do("POST", "/api/users/"+strconv.Itoa(userID)+"/disable", nil); rec.Code != http.StatusOK {
+				t.Fatalf("disabling: %d %s", rec.Code, rec.Body.String())
+			}
+		}},
+		{"signed out everywhere", func(t *testing.T, s *Server, admin *testClient, userID int) {
+			if rec := admin.do("POST", "/api/users/"+strconv.Itoa(userID)+"/logout", nil); rec.Code != http.StatusOK {
+				t.Fatalf("signing out: %d %s", rec.Code, rec.Body.String())
+			}
+		}},
+		{"password changed", func(t *testing.T, s *Server, _ *testClient, userID int) {
+			owner := newTestClient(t, s)
+			owner.login("viewer@example.org", testPassword)
+			rec := owner.do("POST", "/api/update-profile", map[string]string{
+				"old_password": testPassword, "new_password": "a new password",
+			})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("changing password: %d %s", rec.Code, rec.Body.String())
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			userID := createTestUser(t, s, "viewer@example.org", "stake_viewer")
+			owner := newTestClient(t, s)
+			owner.login("viewer@example.org", testPassword)
+			script := createAPIToken(t, owner, permReadLeaderboard)
+			admin := newTestClient(t, s)
+			admin.login("admin@templepoints.org", "admin123")
+
+			if rec := script.do("GET", "/api/leaderboard", nil); rec.Code != http.StatusOK {
+				t.Fatalf("before: status %d", rec.Code)
+			}
+			tt.revoke(t, s, admin, userID)
+			if rec := script.do("GET", "/api/leaderboard", nil); rec.Code != http.StatusUnauthorized {
+				t.Errorf("after: status %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
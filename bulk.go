@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxBulkDecisions caps how many submissions one bulk request may decide.
+const maxBulkDecisions = 200
+
+// BulkDecisionResult reports what happened to one submission in a bulk
+// approve or reject.
+type BulkDecisionResult struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"` // "approved", "rejected" or "skipped"
+	Error  string `json:"error,omitempty"`
+}
+
+// Approve or reject many pending submissions at once, e.g. after a temple
+// trip. Submissions the user can't decide, or that aren't pending, are
+// skipped and reported; the rest are decided in a single transaction.
+func (s *Server) handleBulkDecision(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"` // "approve" or "reject"
+		IDs    []int  `json:"ids"`
+		Reason string `json:"reason"` // required to reject
+
+		// Optionally, the version of each submission the approver reviewed,
+		// keyed by ID
+		Versions map[int]int `json:"versions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	d := decision{Status: "approved"}
+	switch req.Action {
+	case "approve":
+	case "reject":
+		d = decision{Status: "rejected", Reason: strings.TrimSpace(req.Reason)}
+		if d.Reason == "" {
+			http.Error(w, "A reason is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, `Action must be "approve" or "reject"`, http.StatusBadRequest)
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		http.Error(w, "No submissions given", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBulkDecisions {
+		http.Error(w, fmt.Sprintf("At most %d submissions can be decided at once", maxBulkDecisions),
+			http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	results := []BulkDecisionResult{}
+	var decided []*PointSubmission
+	canApprove := map[int]bool{}
+	seen := map[int]bool{}
+
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		result := BulkDecisionResult{ID: id, Status: "skipped"}
+
+		submission, err := querySubmission(tx, id)
+		if err == sql.ErrNoRows {
+			result.Error = "Submission not found"
+			results = append(results, result)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error loading submission %d: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		allowed, checked := canApprove[submission.WardID]
+		if !checked {
+			allowed = s.canApproveForWard(userID, submission.WardID)
+			canApprove[submission.WardID] = allowed
+		}
+		if !allowed {
+			result.Error = "Not authorized to approve for this ward"
+			results = append(results, result)
+			continue
+		}
+
+		if !submission.undecided() {
+			result.Error = fmt.Sprintf("Submission has already been %s", submission.Status)
+			results = append(results, result)
+			continue
+		}
+
+		if version, ok := req.Versions[id]; ok && version != submission.Version {
+			result.Error = "Submission was changed by someone else"
+			results = append(results, result)
+			continue
+		}
+
+		d.Points = submission.Points
+		if err := decideSubmission(tx, submission, userID, d); err != nil {
+			if err == errSubmissionNotPending || err == errSubmissionAmended {
+				result.Error = "Submission was changed by someone else"
+				results = append(results, result)
+				continue
+			}
+			log.Printf("Error deciding submission %d: %v", id, err)
+			http.Error(w, "Failed to process submissions", http.StatusInternalServerError)
+			return
+		}
+
+		result.Status = d.Status
+		results = append(results, result)
+		decided = append(decided, submission)
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to process submissions", http.StatusInternalServerError)
+		return
+	}
+
+	wards := map[int]bool{}
+	for _, submission := range decided {
+		wards[submission.WardID] = true
+
+		if d.Status == "approved" {
+			s.logActivity(submission.WardID, &userID, "points_approved",
+				fmt.Sprintf("Approved %d points from %s", submission.Points, submission.SubmitterName),
+				submission.Points)
+		} else {
+			s.logActivity(submission.WardID, &userID, "points_rejected",
+				fmt.Sprintf("Rejected %d points from %s: %s", submission.Points, submission.SubmitterName, d.Reason),
+				0)
+		}
+	}
+
+	if d.Status == "approved" {
+		for wardID := range wards {
+			s.checkAndAwardAchievements(wardID)
+		}
+	}
+
+	// One update for the whole batch rather than one per submission
+	if len(decided) > 0 {
+		s.broadcastLeaderboardUpdate()
+	}
+
+	verb := "Approved"
+	if d.Status == "rejected" {
+		verb = "Rejected"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("%s %d of %d submissions", verb, len(decided), len(results)),
+		"results": results,
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestBulkDecision(t *testing.T) {
+	s := newTestServer(t)
+	createTestUser(t, s, "approver@example.org", "ward_approver", 1)
+	approver := newTestClient(t, s)
+	approver.login("approver@example.org", testPassword)
+
+	first := submitPoints(t, s, 1, 2)
+	second := submitPoints(t, s, 1, 3)
+	stale := submitPoints(t, s, 1, 4)
+	decided := submitPoints(t, s, 1, 5)
+	otherWard := submitPoints(t, s, 2, 6)
+
+	if rec := approver.do("POST", pointsPath(decided.ID, "reject"), map[string]interface{}{"reason": "Duplicate"}); rec.Code != http.StatusOK {
+		t.Fatalf("reject: %d %s", rec.Code, rec.Body.String())
+	}
+	points, pending := wardTotals(t, s, 1)
+	otherPoints, otherPending := wardTotals(t, s, 2)
+
+	rec := approver.do("POST", "/api/points/bulk", map[string]interface{}{
+		"action":   "approve",
+		"ids":      []int{first.ID, second.ID, stale.ID, decided.ID, otherWard.ID, 999999, first.ID},
+		"versions": map[string]int{strconv.Itoa(second.ID): 1, strconv.Itoa(stale.ID): 0},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bulk approve: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Results []BulkDecisionResult `json:"results"`
+	}
+	decodeJSON(t, rec, &resp)
+
+	want := map[int]string{
+		first.ID:     "approved",
+		second.ID:    "approved",
+		stale.ID:     "skipped",
+		decided.ID:   "skipped",
+		otherWard.ID: "skipped",
+		999999:       "skipped",
+	}
+	if len(resp.Results) != len(want) {
+		t.Errorf("%d results, want %d: %+v", len(resp.Results), len(want), resp.Results)
+	}
+	for _, result := range resp.Results {
+		if result.Status != want[result.ID] {
+			t.Errorf("submission %d: %s (%s), want %s", result.ID, result.Status, result.Error, want[result.ID])
+		}
+		if (result.Status == "skipped") != (result.Error != "") {
+			t.Errorf("submission %d: status %s with error %q", result.ID, result.Status, result.Error)
+		}
+	}
+
+	approved := first.Points + second.Points
+	if gotPoints, gotPending := wardTotals(t, s, 1); gotPoints != points+approved || gotPending != pending-approved {
+		t.Errorf("ward totals = %d, %d; want %d, %d", gotPoints, gotPending, points+approved, pending-approved)
+	}
+	if gotPoints, gotPending := wardTotals(t, s, 2); gotPoints != otherPoints || gotPending != otherPending {
+		t.Errorf("other ward's totals changed to %d, %d", gotPoints, gotPending)
+	}
+}
+
+func TestBulkDecisionRequests(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	sub := submitPoints(t, s, 1, 2)
+
+	tooMany := make([]int, maxBulkDecisions+1)
+	for i := range tooMany {
+		tooMany[i] = sub.ID
+	}
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"reject without a reason", map[string]interface{}{"action": "reject", "ids": []int{sub.ID}, "reason": " "}},
+		{"unknown action", map[string]interface{}{"action": "withdraw", "ids": []int{sub.ID}}},
+		{"no submissions", map[string]interface{}{"action": "approve", "ids": []int{}}},
+		{"too many submissions", map[string]interface{}{"action": "approve", "ids": tooMany}},
+	}
+
+	for _, tt := range tests {
+		if rec := admin.do("POST", "/api/points/bulk", tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	rec := admin.do("POST", "/api/points/bulk", map[string]interface{}{
+		"action": "reject", "ids": []int{sub.ID}, "reason": "Duplicate",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bulk reject: %d %s", rec.Code, rec.Body.String())
+	}
+	var status, reason string
+	s.db.QueryRow(`SELECT status, rejection_reason FROM point_submissions WHERE id = ?`, sub.ID).Scan(&status, &reason)
+	if status != "rejected" || reason != "Duplicate" {
+		t.Errorf("submission is %s with reason %q", status, reason)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// IntegrityReport is the result of checkIntegrity. Wards summarises every
+// ward's totals; Problems lists what was wrong and whether it was repaired.
+type IntegrityReport struct {
+	Wards    []WardReconciliation `json:"wards"`
+	Problems []IntegrityProblem   `json:"problems"`
+	Repaired bool                 `json:"repaired"`
+}
+
+type WardReconciliation struct {
+	WardID   int    `json:"ward_id"`
+	WardName string `json:"ward_name"`
+
+	// Totals recomputed from point_submissions, plus manual adjustments
+	ApprovedPoints  int `json:"approved_points"`
+	PendingPoints   int `json:"pending_points"`
+	AdjustedPoints  int `json:"adjusted_points"`
+	AdjustedPending int `json:"adjusted_pending_points"`
+
+	LedgerPoints  int `json:"ledger_points"`
+	LedgerPending int `json:"ledger_pending_points"`
+	CachedPoints  int `json:"cached_points"`
+	CachedPending int `json:"cached_pending_points"`
+}
+
+type IntegrityProblem struct {
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+	Fixed  bool   `json:"fixed"`
+}
+
+func (r *IntegrityReport) add(check string, fixed bool, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, IntegrityProblem{
+		Check:  check,
+		Detail: fmt.Sprintf(format, args...),
+		Fixed:  fixed,
+	})
+}
+
+// Unfixed counts the problems still needing attention.
+func (r *IntegrityReport) Unfixed() int {
+	n := 0
+	for _, p := range r.Problems {
+		if !p.Fixed {
+			n++
+		}
+	}
+	return n
+}
+
+// checkIntegrity reconciles ward totals with point_submissions and the
+// ledger, and looks for broken references. With repair it also fixes what
+// it safely can; the caller commits tx to keep the repairs. The ledger is
+// only ever appended to.
+func checkIntegrity(tx *sql.Tx, repair bool) (*IntegrityReport, error) {
+	report := &IntegrityReport{Wards: []WardReconciliation{}, Problems: []IntegrityProblem{}, Repaired: repair}
+
+	if err := checkActivityLogs(tx, report, repair); err != nil {
+		return nil, fmt.Errorf("checking activity logs: %w", err)
+	}
+	if err := checkForeignKeys(tx, report); err != nil {
+		return nil, fmt.Errorf("checking foreign keys: %w", err)
+	}
+	if err := checkSubmissionLedger(tx, report, repair); err != nil {
+		return nil, fmt.Errorf("checking submissions against the ledger: %w", err)
+	}
+	if err := checkWardTotals(tx, report, repair); err != nil {
+		return nil, fmt.Errorf("checking ward totals: %w", err)
+	}
+
+	return report, nil
+}
+
+// checkActivityLogs finds log entries pointing at wards or users that don't
+// exist, including the ward_id = 0 rows older versions wrote for stake-wide
+// events. Repair makes them stake-wide or anonymous.
+func checkActivityLogs(tx *sql.Tx, report *IntegrityReport, repair bool) error {
+	checks := []struct {
+		column, parent, label, fix string
+	}{
+		{"ward_id", "wards", "ward", "made stake-wide"},
+		{"user_id", "users", "user", "detached from the user"},
+	}
+
+	for _, c := range checks {
+		where := fmt.Sprintf(`%s IS NOT NULL AND %s NOT IN (SELECT id FROM %s)`, c.column, c.column, c.parent)
+
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM activity_logs WHERE ` + where).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+
+		if repair {
+			if _, err := tx.Exec(fmt.Sprintf(`UPDATE activity_logs SET %s = NULL WHERE %s`, c.column, where)); err != nil {
+				return err
+			}
+			report.add("activity_logs", true, "%d activity log row(s) pointed at a missing %s; %s", count, c.label, c.fix)
+		} else {
+			report.add("activity_logs", false, "%d activity log row(s) point at a missing %s", count, c.label)
+		}
+	}
+	return nil
+}
+
+// checkForeignKeys reports any other rows with dangling references. These
+// aren't repaired automatically because the right fix depends on the data.
+// activity_logs is left to checkActivityLogs.
+func checkForeignKeys(tx *sql.Tx, report *IntegrityReport) error {
+	rows, err := tx.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkID int
+		if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return err
+		}
+		if table == "activity_logs" {
+			continue
+		}
+		report.add("foreign_keys", false, "%s row %d references a missing %s row", table, rowID.Int64, parent)
+	}
+	return rows.Err()
+}
+
+// checkSubmissionLedger makes sure each submission's ledger entries add up
+// to what its status says: pending points while pending, verified points
+// once approved, and nothing once rejected. Repair appends a correcting
+// entry.
+func checkSubmissionLedger(tx *sql.Tx, report *IntegrityReport, repair bool) error {
+	rows, err := tx.Query(`
+		SELECT p.id, p.ward_id, p.submitter_name, p.points, p.awarded_points, p.status,
+		       COALESCE(SUM(l.verified_delta), 0), COALESCE(SUM(l.pending_delta), 0)
+		FROM point_submissions p
+		LEFT JOIN points_ledger l ON l.submission_id = p.id
+		GROUP BY p.id
+		ORDER BY p.id
+	`)
+	if err != nil {
+		return err
+	}
+
+	var corrections []LedgerEntry
+	for rows.Next() {
+		var s PointSubmission
+		var verified, pending int
+		err := rows.Scan(&s.ID, &s.WardID, &s.SubmitterName, &s.Points, &s.AwardedPoints, &s.Status,
+			&verified, &pending)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		wantVerified, wantPending := 0, 0
+		switch s.Status {
+		case "approved":
+			wantVerified = s.awarded()
+		case "pending", "needs_info":
+			wantPending = s.Points
+		}
+
+		if verified == wantVerified && pending == wantPending {
+			continue
+		}
+
+		id := s.ID
+		corrections = append(corrections, LedgerEntry{
+			WardID:        s.WardID,
+			SubmissionID:  &id,
+			EntryType:     ledgerAdjustment,
+			VerifiedDelta: wantVerified - verified,
+			PendingDelta:  wantPending - pending,
+			Note:          fmt.Sprintf("Integrity check: ledger didn't match %s submission", s.Status),
+		})
+		report.add("submissions", repair,
+			"Submission %d (%d points from %s, %s) has %d verified and %d pending in the ledger; expected %d and %d",
+			s.ID, s.Points, s.SubmitterName, s.Status, verified, pending, wantVerified, wantPending)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if repair {
+		for _, entry := range corrections {
+			if err := recordLedgerEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkWardTotals recomputes each ward's totals from its submissions and
+// compares them, and the ledger, with the cached totals on wards. Repair
+// rebuilds the cache from the ledger.
+func checkWardTotals(tx *sql.Tx, report *IntegrityReport, repair bool) error {
+	rows, err := tx.Query(`
+		SELECT w.id, w.name, COALESCE(w.points, 0), COALESCE(w.pending_points, 0),
+		       (SELECT COALESCE(SUM(COALESCE(awarded_points, points)), 0) FROM point_submissions
+		        WHERE ward_id = w.id AND status = 'approved'),
+		       (SELECT COALESCE(SUM(points), 0) FROM point_submissions
+		        WHERE ward_id = w.id AND status IN ('pending', 'needs_info')),
+		       (SELECT COALESCE(SUM(verified_delta), 0) FROM points_ledger
+		        WHERE ward_id = w.id AND entry_type = 'adjustment' AND submission_id IS NULL),
+		       (SELECT COALESCE(SUM(pending_delta), 0) FROM points_ledger
+		        WHERE ward_id = w.id AND entry_type = 'adjustment' AND submission_id IS NULL),
+		       (SELECT COALESCE(SUM(verified_delta), 0) FROM points_ledger WHERE ward_id = w.id),
+		       (SELECT COALESCE(SUM(pending_delta), 0) FROM points_ledger WHERE ward_id = w.id)
+		FROM wards w
+		ORDER BY w.id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	drifted := false
+	for rows.Next() {
+		var ward WardReconciliation
+		err := rows.Scan(&ward.WardID, &ward.WardName, &ward.CachedPoints, &ward.CachedPending,
+			&ward.ApprovedPoints, &ward.PendingPoints, &ward.AdjustedPoints, &ward.AdjustedPending,
+			&ward.LedgerPoints, &ward.LedgerPending)
+		if err != nil {
+			return err
+		}
+
+		if ward.CachedPoints != ward.LedgerPoints || ward.CachedPending != ward.LedgerPending {
+			drifted = true
+			report.add("ward_totals", repair,
+				"%s shows %d points (%d pending) but its ledger adds up to %d (%d pending)",
+				ward.WardName, ward.CachedPoints, ward.CachedPending, ward.LedgerPoints, ward.LedgerPending)
+			if repair {
+				ward.CachedPoints, ward.CachedPending = ward.LedgerPoints, ward.LedgerPending
+			}
+		}
+
+		// What's shown should also be what the submissions themselves add up
+		// to. Repairing the ledger and cache normally fixes this; anything
+		// left over needs a person to look at it.
+		expectedPoints := ward.ApprovedPoints + ward.AdjustedPoints
+		expectedPending := ward.PendingPoints + ward.AdjustedPending
+		if ward.CachedPoints != expectedPoints || ward.CachedPending != expectedPending {
+			report.add("ward_totals", false,
+				"%s shows %d points (%d pending) but its submissions and adjustments add up to %d (%d pending)",
+				ward.WardName, ward.CachedPoints, ward.CachedPending, expectedPoints, expectedPending)
+		}
+
+		report.Wards = append(report.Wards, ward)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if repair && drifted {
+		return recomputeWardTotals(tx)
+	}
+	return nil
+}
+
+// checkSchema makes sure db has every table and column the checks read. With
+// migrate it first runs the same migrations as server startup, so a database
+// from an older version can be checked and repaired before the server has
+// ever run against it; otherwise such a database is an error saying so.
+func checkSchema(db *sql.DB, migrate bool) error {
+	if migrate {
+		if err := createTables(db); err != nil {
+			return fmt.Errorf("creating tables: %w", err)
+		}
+		if err := migrateDB(db); err != nil {
+			return fmt.Errorf("migrating database: %w", err)
+		}
+		return nil
+	}
+
+	missing, err := missingSchema(db)
+	if err != nil {
+		return fmt.Errorf("reading database schema: %w", err)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the database is from an older version (missing %s); "+
+			"run `templepoints check -repair` to migrate and repair it, or start the server once to migrate it",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// runCheckCommand implements `templepoints check [-repair] [-json]`. It
+// returns the process exit code: 1 if problems remain.
+func runCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems found")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	// Never create a database just to check it
+	db, err := openExistingDB(!*repair)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return 2
+	}
+	defer db.Close()
+
+	if err := checkSchema(db, *repair); err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return 2
+	}
+	defer tx.Rollback()
+
+	report, err := checkIntegrity(tx, *repair)
+	if err != nil {
+		log.Printf("Integrity check failed: %v", err)
+		return 2
+	}
+
+	if *repair {
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error saving repairs: %v", err)
+			return 2
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printIntegrityReport(report)
+	}
+
+	if report.Unfixed() > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printIntegrityReport(report *IntegrityReport) {
+	fmt.Printf("%-28s %9s %9s %9s %9s %9s\n", "Ward", "Approved", "Pending", "Adjusted", "Ledger", "Shown")
+	for _, w := range report.Wards {
+		fmt.Printf("%-28s %9d %9d %9d %9d %9d\n", w.WardName, w.ApprovedPoints, w.PendingPoints,
+			w.AdjustedPoints, w.LedgerPoints, w.CachedPoints)
+	}
+	fmt.Println()
+
+	if len(report.Problems) == 0 {
+		fmt.Println("No problems found.")
+		return
+	}
+
+	for _, p := range report.Problems {
+		status := "FOUND"
+		if p.Fixed {
+			status = "FIXED"
+		}
+		fmt.Printf("[%s] %s: %s\n", status, p.Check, p.Detail)
+	}
+
+	fmt.Printf("\n%d problem(s), %d fixed.", len(report.Problems), len(report.Problems)-report.Unfixed())
+	if !report.Repaired && report.Unfixed() > 0 {
+		fmt.Print(" Run with -repair to fix what can be fixed automatically.")
+	}
+	fmt.Println()
+}
+
+// Run the integrity check (admin only). GET only reports; POST with
+// {"repair": true} also fixes what it can.
+func (s *Server) handleIntegrityCheck(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Repair bool `json:"repair"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	report, err := checkIntegrity(tx, req.Repair)
+	if err != nil {
+		log.Printf("Integrity check failed: %v", err)
+		http.Error(w, "Integrity check failed", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Repair {
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to save repairs", http.StatusInternalServerError)
+			return
+		}
+
+		if fixed := len(report.Problems) - report.Unfixed(); fixed > 0 {
+			s.logActivity(0, &userID, "integrity_repaired",
+				fmt.Sprintf("Integrity check repaired %d problem(s)", fixed), 0)
+			s.broadcastLeaderboardUpdate()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
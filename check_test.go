@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is the schema from before the ledger and the other
+// migrations, when stake-wide activity was logged with ward_id = 0.
+const baselineSchema = `
+	CREATE TABLE wards (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		points INTEGER DEFAULT 0,
+		pending_points INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		role TEXT NOT NULL CHECK(role IN ('admin', 'ward_approver')),
+		ward_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (ward_id) REFERENCES wards(id)
+	);
+	CREATE TABLE point_submissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ward_id INTEGER NOT NULL,
+		submitter_name TEXT NOT NULL,
+		points INTEGER NOT NULL,
+		note TEXT,
+		status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected')),
+		approved_by INTEGER,
+		approved_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (ward_id) REFERENCES wards(id),
+		FOREIGN KEY (approved_by) REFERENCES users(id)
+	);
+	CREATE TABLE achievements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ward_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT,
+		icon TEXT,
+		earned_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (ward_id) REFERENCES wards(id),
+		UNIQUE(ward_id, type)
+	);
+	CREATE TABLE activity_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ward_id INTEGER NOT NULL,
+		user_id INTEGER,
+		action TEXT NOT NULL,
+		details TEXT,
+		points INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (ward_id) REFERENCES wards(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	INSERT INTO wards (name, points, pending_points) VALUES ('First Ward', 10, 4), ('Second Ward', 0, 0);
+	INSERT INTO users (email, password, role) VALUES ('admin@example.org', 'x', 'admin');
+	INSERT INTO users (email, password, role, ward_id) VALUES ('approver@example.org', 'x', 'ward_approver', 1);
+	INSERT INTO point_submissions (ward_id, submitter_name, points, status, approved_by, approved_at)
+	VALUES (1, 'Member', 10, 'approved', 1, CURRENT_TIMESTAMP);
+	INSERT INTO point_submissions (ward_id, submitter_name, points) VALUES (1, 'Member', 4);
+	-- What the baseline handleCreateUser logged
+	INSERT INTO activity_logs (ward_id, user_id, action, details) VALUES (0, 1, 'user_created', 'Created user');
+`
+
+// inBaselineDatabaseDir creates a baseline database at databasePath in a
+// temporary directory and makes that the working directory for the test.
+func inBaselineDatabaseDir(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, databasePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(baselineSchema)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestCheckCommandOnBaselineDatabase(t *testing.T) {
+	inBaselineDatabaseDir(t)
+
+	db, err := openExistingDB(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSchema(db, false)
+	db.Close()
+	if err == nil || !strings.Contains(err.Error(), "older version") || !strings.Contains(err.Error(), "table points_ledger") ||
+		!strings.Contains(err.Error(), "activity_logs.ward_id allowing NULL") {
+		t.Errorf("checkSchema on a baseline database = %v", err)
+	}
+
+	if code := runCheckCommand(nil); code != 2 {
+		t.Errorf("check without -repair: exit code %d, want 2", code)
+	}
+	if code := runCheckCommand([]string{"-repair"}); code != 0 {
+		t.Fatalf("check -repair: exit code %d, want 0", code)
+	}
+	if code := runCheckCommand(nil); code != 0 {
+		t.Errorf("check after -repair: exit code %d, want 0", code)
+	}
+
+	db, err = openExistingDB(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wardID sql.NullInt64
+	db.QueryRow(`SELECT ward_id FROM activity_logs WHERE action = 'user_created'`).Scan(&wardID)
+	if wardID.Valid {
+		t.Errorf("baseline stake-wide log entry still has ward_id %d", wardID.Int64)
+	}
+
+	var points, pending int
+	db.QueryRow(`SELECT points, pending_points FROM wards WHERE id = 1`).Scan(&points, &pending)
+	if points != 10 || pending != 4 {
+		t.Errorf("ward totals after repair = %d, %d; want 10, 4", points, pending)
+	}
+	if missing, err := missingSchema(db); err != nil || len(missing) != 0 {
+		t.Errorf("still missing %v, %v", missing, err)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt string
+		check   string
+		fixable bool
+	}{
+		{"cached totals drifted", `UPDATE wards SET points = points + 7 WHERE id = 2`, "ward_totals", true},
+		{"ledger entry missing for a submission",
+			`INSERT INTO points_ledger (ward_id, submission_id, entry_type, pending_delta)
+			 SELECT ward_id, id, 'adjustment', -points FROM point_submissions WHERE status = 'pending' LIMIT 1`,
+			"submissions", true},
+		{"submission changed behind the ledger's back",
+			`UPDATE point_submissions SET points = points + 5 WHERE id = (SELECT MIN(id) FROM point_submissions WHERE status = 'pending')`,
+			"submissions", true},
+		{"log entry for a missing ward",
+			`PRAGMA foreign_keys = OFF; INSERT INTO activity_logs (ward_id, action) VALUES (99, 'points_submitted')`, "activity_logs", true},
+		{"submission for a missing ward",
+			`PRAGMA foreign_keys = OFF; INSERT INTO point_submissions (ward_id, submitter_name, points, status) VALUES (99, 'X', 0, 'rejected')`,
+			"foreign_keys", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.db.SetMaxOpenConns(1)
+
+			if report := runIntegrityCheck(t, s.db, false); report.Unfixed() != 0 {
+				t.Fatalf("fresh database has problems: %+v", report.Problems)
+			}
+			if _, err := s.db.Exec(tt.corrupt); err != nil {
+				t.Fatal(err)
+			}
+			s.db.Exec(`PRAGMA foreign_keys = ON`)
+
+			report := runIntegrityCheck(t, s.db, false)
+			if !hasProblem(report, tt.check) {
+				t.Fatalf("no %s problem reported: %+v", tt.check, report.Problems)
+			}
+
+			runIntegrityCheck(t, s.db, true)
+			after := runIntegrityCheck(t, s.db, false)
+			if fixed := !hasProblem(after, tt.check); fixed != tt.fixable {
+				t.Errorf("after repair, %s fixed = %v, want %v: %+v", tt.check, fixed, tt.fixable, after.Problems)
+			}
+		})
+	}
+}
+
+func runIntegrityCheck(t *testing.T, db *sql.DB, repair bool) *IntegrityReport {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	report, err := checkIntegrity(tx, repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repair {
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return report
+}
+
+func hasProblem(report *IntegrityReport, check string) bool {
+	for _, p := range report.Problems {
+		if p.Check == check {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCommentLength caps a single comment, in characters.
+const maxCommentLength = 2000
+
+func submissionComments(q rowQuerier, submissionID int) ([]SubmissionComment, error) {
+	rows, err := q.Query(`
+		SELECT id, author_name, from_submitter, body, created_at
+		FROM submission_comments
+		WHERE submission_id = ?
+		ORDER BY id
+	`, submissionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []SubmissionComment{}
+	for rows.Next() {
+		var c SubmissionComment
+		if err := rows.Scan(&c.ID, &c.AuthorName, &c.FromSubmitter, &c.Body, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// commentBody reads and checks the body of a new comment, writing a 400 and
+// returning "" if it's missing or too long.
+func commentBody(w http.ResponseWriter, r *http.Request, needsInfo *bool) string {
+	var req struct {
+		Body      string `json:"body"`
+		NeedsInfo bool   `json:"needs_info"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return ""
+	}
+
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		http.Error(w, "A comment is required", http.StatusBadRequest)
+		return ""
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("Comments can be at most %d characters", maxCommentLength), http.StatusBadRequest)
+		return ""
+	}
+
+	if needsInfo != nil {
+		*needsInfo = req.NeedsInfo
+	}
+	return body
+}
+
+// addSubmissionComment adds a comment inside tx. A nil userID means it's
+// from the submitter.
+func addSubmissionComment(tx *sql.Tx, submissionID int, userID *int, authorName, body string) error {
+	_, err := tx.Exec(`
+		INSERT INTO submission_comments (submission_id, user_id, from_submitter, author_name, body)
+		VALUES (?, ?, ?, ?, ?)
+	`, submissionID, userID, userID == nil, authorName, body)
+	return err
+}
+
+// See the comments on a submission
+func (s *Server) handleGetSubmissionComments(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	submissionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+
+	submission := s.loadSubmission(w, submissionID)
+	if submission == nil {
+		return
+	}
+
+	if !s.hasPermission(userID, permViewSubmissions, submission.WardID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	comments, err := submissionComments(s.db, submission.ID)
+	if err != nil {
+		log.Printf("Error loading submission comments: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"comments": comments,
+	})
+}
+
+// Comment on a submission as an approver. With needs_info set, the
+// submission waits on the submitter's reply before it's decided.
+func (s *Server) handlePostSubmissionComment(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	submissionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+
+	var needsInfo bool
+	body := commentBody(w, r, &needsInfo)
+	if body == "" {
+		return
+	}
+
+	submission := s.loadSubmission(w, submissionID)
+	if submission == nil {
+		return
+	}
+
+	if !s.canApproveForWard(userID, submission.WardID) {
+		http.Error(w, "Not authorized to approve for this ward", http.StatusForbidden)
+		return
+	}
+
+	if needsInfo && !submission.undecided() {
+		http.Error(w, fmt.Sprintf("Submission has already been %s", submission.Status), http.StatusConflict)
+		return
+	}
+
+	var role string
+	s.db.QueryRow(`SELECT role FROM users WHERE id = ?`, userID).Scan(&role)
+	authorName := roleDefinitions[role].Label
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if needsInfo {
+		result, err := tx.Exec(`
+			UPDATE point_submissions SET status = 'needs_info'
+			WHERE id = ? AND status IN ('pending', 'needs_info')
+		`, submission.ID)
+		if err != nil {
+			log.Printf("Error asking about submission %d: %v", submission.ID, err)
+			http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected != 1 {
+			http.Error(w, "Submission was already decided by someone else", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := addSubmissionComment(tx, submission.ID, &userID, authorName, body); err != nil {
+		log.Printf("Error adding comment to submission %d: %v", submission.ID, err)
+		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+		return
+	}
+
+	if needsInfo {
+		s.logActivity(submission.WardID, &userID, "submission_needs_info",
+			fmt.Sprintf("Asked %s about their submission of %d points", submission.SubmitterName, submission.Points), 0)
+	} else {
+		s.logActivity(submission.WardID, &userID, "submission_comment",
+			fmt.Sprintf("Commented on %s's submission of %d points", submission.SubmitterName, submission.Points), 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Comment added",
+	})
+}
+
+// Reply to an approver as the submitter, by receipt code. A reply to a
+// question puts the submission back in the approval queue.
+func (s *Server) handleReceiptComment(w http.ResponseWriter, r *http.Request) {
+	body := commentBody(w, r, nil)
+	if body == "" {
+		return
+	}
+
+	sub := s.receiptSubmission(w, r)
+	if sub == nil {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE point_submissions SET status = 'pending' WHERE id = ? AND status = 'needs_info'`, sub.ID)
+	if err == nil {
+		err = addSubmissionComment(tx, sub.ID, nil, sub.SubmitterName, body)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error adding comment to submission %d: %v", sub.ID, err)
+		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(sub.WardID, nil, "submission_reply",
+		fmt.Sprintf("%s replied about their submission of %d points", sub.SubmitterName, sub.Points), 0)
+
+	s.notifyUsers(s.commentRecipients(sub), "submission-comment", map[string]interface{}{
+		"submission_id":  sub.ID,
+		"ward_name":      sub.WardName,
+		"submitter_name": sub.SubmitterName,
+		"body":           body,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Your reply has been sent",
+	})
+}
+
+// commentRecipients returns who to tell about a submitter's comment: the
+// approvers already in the thread, or if none of them can still act on it,
+// everyone who can approve for the ward.
+func (s *Server) commentRecipients(sub *PointSubmission) []int {
+	candidates, err := queryUserIDs(s.db, `
+		SELECT DISTINCT user_id FROM submission_comments
+		WHERE submission_id = ? AND user_id IS NOT NULL
+	`, sub.ID)
+	if err != nil {
+		log.Printf("Error finding comment recipients: %v", err)
+		return nil
+	}
+
+	recipients := []int{}
+	for _, id := range candidates {
+		if s.canApproveForWard(id, sub.WardID) {
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) > 0 {
+		return recipients
+	}
+
+	candidates, err = queryUserIDs(s.db, `SELECT id FROM users WHERE disabled = 0`)
+	if err != nil {
+		log.Printf("Error finding comment recipients: %v", err)
+		return nil
+	}
+	for _, id := range candidates {
+		if s.canApproveForWard(id, sub.WardID) {
+			recipients = append(recipients, id)
+		}
+	}
+	return recipients
+}
+
+func queryUserIDs(q rowQuerier, query string, args ...interface{}) ([]int, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
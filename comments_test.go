@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSubmissionQuestionAndReply(t *testing.T) {
+	s := newTestServer(t)
+	approverID := createTestUser(t, s, "approver@example.org", "ward_approver", 1)
+	approver := newTestClient(t, s)
+	approver.login("approver@example.org", testPassword)
+	submitter := newTestClient(t, s)
+	sub := submitPoints(t, s, 1, 3)
+	_, pending := wardTotals(t, s, 1)
+
+	status := func() string {
+		var status string
+		s.db.QueryRow(`SELECT status FROM point_submissions WHERE id = ?`, sub.ID).Scan(&status)
+		return status
+	}
+
+	rec := approver.do("POST", pointsPath(sub.ID, "comments"), map[string]interface{}{
+		"body": "Which temple was this at?", "needs_info": true,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("asking: %d %s", rec.Code, rec.Body.String())
+	}
+	if got := status(); got != "needs_info" {
+		t.Errorf("status after question = %s, want needs_info", got)
+	}
+	if _, got := wardTotals(t, s, 1); got != pending {
+		t.Errorf("pending points = %d, want %d", got, pending)
+	}
+
+	rec = submitter.do("GET", receiptPath(sub.ReceiptCode), nil)
+	var receipt struct {
+		Comments []SubmissionComment `json:"comments"`
+	}
+	decodeJSON(t, rec, &receipt)
+	if len(receipt.Comments) != 1 || receipt.Comments[0].Body != "Which temple was this at?" || receipt.Comments[0].FromSubmitter {
+		t.Errorf("receipt comments = %+v", receipt.Comments)
+	}
+
+	if rec := submitter.do("POST", receiptPath(sub.ReceiptCode)+"/comments", map[string]interface{}{"body": "Provo City Center"}); rec.Code != http.StatusOK {
+		t.Fatalf("replying: %d %s", rec.Code, rec.Body.String())
+	}
+	if got := status(); got != "pending" {
+		t.Errorf("status after reply = %s, want pending", got)
+	}
+
+	rec = approver.do("GET", pointsPath(sub.ID, "comments"), nil)
+	var thread struct {
+		Comments []SubmissionComment `json:"comments"`
+	}
+	decodeJSON(t, rec, &thread)
+	if len(thread.Comments) != 2 || !thread.Comments[1].FromSubmitter || thread.Comments[1].AuthorName != "Test Member" {
+		t.Errorf("thread = %+v", thread.Comments)
+	}
+
+	// The approver who asked hears about the reply, not everyone
+	full, err := querySubmission(s.db, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.commentRecipients(full); len(got) != 1 || got[0] != approverID {
+		t.Errorf("comment recipients = %v, want [%d]", got, approverID)
+	}
+}
+
+func TestSubmissionCommentChecks(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	createTestUser(t, s, "other@example.org", "ward_approver", 2)
+	otherWard := newTestClient(t, s)
+	otherWard.login("other@example.org", testPassword)
+	sub := submitPoints(t, s, 1, 1)
+
+	// A submission with a question out can still be decided
+	admin.do("POST", pointsPath(sub.ID, "comments"), map[string]interface{}{"body": "Date?", "needs_info": true})
+	if rec := admin.do("POST", pointsPath(sub.ID, "approve"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("approving with a question out: %d %s", rec.Code, rec.Body.String())
+	}
+	pending := submitPoints(t, s, 1, 1)
+
+	tests := []struct {
+		name   string
+		client *testClient
+		id     int
+		body   string
+		ask    bool
+		want   int
+	}{
+		{"empty", admin, pending.ID, "  ", false, http.StatusBadRequest},
+		{"too long", admin, pending.ID, strings.Repeat("x", maxCommentLength+1), false, http.StatusBadRequest},
+		{"approver for another ward", otherWard, pending.ID, "Hello", false, http.StatusForbidden},
+		{"comment on a decided submission", admin, sub.ID, "Thanks", false, http.StatusOK},
+		{"question on a decided submission", admin, sub.ID, "Date?", true, http.StatusConflict},
+		{"signed out", newTestClient(t, s), pending.ID, "Hello", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := tt.client.do("POST", pointsPath(tt.id, "comments"), map[string]interface{}{"body": tt.body, "needs_info": tt.ask})
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+
+	if rec := otherWard.do("GET", pointsPath(pending.ID, "comments"), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("reading another ward's comments: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
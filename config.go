@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Config holds settings read from the environment at startup.
+type Config struct {
+	// BaseURL is the public address used in emailed links, e.g.
+	// https://templepoints.example.com. Emails carrying a token are only
+	// sent when it is set; other links fall back to the request's host.
+	BaseURL string
+
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// OpenID Connect single sign-on is offered when OIDCIssuer is set.
+	// OIDCRedirectURL defaults to BaseURL + /login/oidc/callback. When
+	// OIDCDefaultRole is set, unknown emails get a new account with that role
+	// (and the comma-separated OIDCDefaultWards); otherwise they're refused.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCProviderName string
+	OIDCDefaultRole  string
+	OIDCDefaultWards string
+}
+
+func loadConfig() *Config {
+	return &Config{
+		BaseURL:      strings.TrimRight(os.Getenv("BASE_URL"), "/"),
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     getEnv("SMTP_PORT", "587"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:     getEnv("SMTP_FROM", "Temple Points <noreply@templepoints.org>"),
+
+		OIDCIssuer:       os.Getenv("OIDC_ISSUER"),
+		OIDCClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		OIDCProviderName: getEnv("OIDC_PROVIDER_NAME", "Single Sign-On"),
+		OIDCDefaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+		OIDCDefaultWards: os.Getenv("OIDC_DEFAULT_WARDS"),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// errNoBaseURL is returned when a token would have to be emailed but BASE_URL
+// isn't configured.
+var errNoBaseURL = errors.New("BASE_URL is not configured; refusing to email a link")
+
+// emailLinkBaseURL returns the configured public address for links that carry
+// a token. The request's Host header is chosen by the client, so a link built
+// from it could deliver the token to someone else's site.
+func (s *Server) emailLinkBaseURL() (string, error) {
+	if s.config.BaseURL == "" {
+		return "", errNoBaseURL
+	}
+	return s.config.BaseURL, nil
+}
+
+// baseURL returns the public address of the site for building links shown to
+// the requester. Never use it for links that are emailed with a token.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.config.BaseURL != "" {
+		return s.config.BaseURL
+	}
+
+	scheme := "http"
+	if isSecureRequest(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	c.login("admin@templepoints.org", "admin123")
+
+	valid := c.cookies[csrfCookieName]
+	if valid == nil {
+		t.Fatal("no CSRF cookie was issued")
+	}
+	forged := "forged-token"
+
+	tests := []struct {
+		name   string
+		cookie string // "" leaves the CSRF cookie off
+		header string
+		want   int
+	}{
+		{"matching signed token", valid.Value, valid.Value, http.StatusOK},
+		{"no header", valid.Value, "", http.StatusForbidden},
+		{"no cookie", "", valid.Value, http.StatusForbidden},
+		{"mismatched header", valid.Value, s.signValue("other"), http.StatusForbidden},
+		{"matching unsigned token", forged, forged, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestClient(t, s)
+			req.cookies[sessionCookieName] = c.cookies[sessionCookieName]
+			if tt.cookie != "" {
+				req.cookies[csrfCookieName] = &http.Cookie{Name: csrfCookieName, Value: tt.cookie}
+			}
+			req.headers[csrfHeaderName] = tt.header
+
+			if rec := req.do("POST", "/api/sessions/revoke-others", nil); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("safe methods need no token", func(t *testing.T) {
+		req := newTestClient(t, s)
+		req.cookies[sessionCookieName] = c.cookies[sessionCookieName]
+		if rec := req.do("GET", "/api/sessions", nil); rec.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("requests without a session need no token", func(t *testing.T) {
+		req := newTestClient(t, s)
+		rec := req.do("POST", "/api/login", map[string]string{"email": "admin@templepoints.org", "password": "admin123"})
+		if rec.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 	
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const databasePath = "./templepoints.db"
+
 func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./templepoints.db?_foreign_keys=on")
+	db, err := sql.Open("sqlite3", databasePath+"?_foreign_keys=on")
 	if err != nil {
 		return nil, err
 	}
@@ -20,6 +26,10 @@ func initDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := migrateDB(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	if err := seedData(db); err != nil {
 		return nil, err
 	}
@@ -27,6 +37,30 @@ func initDB() (*sql.DB, error) {
 	return db, nil
 }
 
+// openExistingDB opens the database as it is, without creating, migrating
+// or seeding it, for tools that inspect it. It fails if there's no database
+// at databasePath.
+func openExistingDB(readOnly bool) (*sql.DB, error) {
+	if _, err := os.Stat(databasePath); err != nil {
+		return nil, err
+	}
+
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	db, err := sql.Open("sqlite3", "file:"+databasePath+"?mode="+mode+"&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 func createTables(db *sql.DB) error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS wards (
@@ -41,26 +75,127 @@ func createTables(db *sql.DB) error {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		email TEXT NOT NULL UNIQUE,
 		password TEXT NOT NULL,
-		role TEXT NOT NULL CHECK(role IN ('admin', 'ward_approver')),
-		ward_id INTEGER,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		role TEXT NOT NULL CHECK(role IN ('admin', 'stake_viewer', 'clerk', 'ward_approver')),
+		totp_secret TEXT,
+		totp_enabled INTEGER NOT NULL DEFAULT 0,
+		totp_last_counter INTEGER NOT NULL DEFAULT 0,
+		disabled INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS user_wards (
+		user_id INTEGER NOT NULL,
+		ward_id INTEGER NOT NULL,
+		PRIMARY KEY (user_id, ward_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 		FOREIGN KEY (ward_id) REFERENCES wards(id)
 	);
 
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS point_submissions (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		ward_id INTEGER NOT NULL,
 		submitter_name TEXT NOT NULL,
 		points INTEGER NOT NULL,
 		note TEXT,
-		status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected')),
+		status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'needs_info', 'approved', 'rejected', 'withdrawn')),
 		approved_by INTEGER,
 		approved_at DATETIME,
+		submitted_by INTEGER,
+		awarded_points INTEGER,
+		approval_note TEXT,
+		rejection_reason TEXT,
+		reversed_by INTEGER,
+		reversed_at DATETIME,
+		reversal_reason TEXT,
+		edit_token_hash TEXT,
+		activity_date TEXT, -- YYYY-MM-DD of the temple visit; see activitydates.go
+		version INTEGER NOT NULL DEFAULT 1, -- bumped by every change to the claim
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (ward_id) REFERENCES wards(id),
+		FOREIGN KEY (approved_by) REFERENCES users(id),
+		FOREIGN KEY (submitted_by) REFERENCES users(id),
+		FOREIGN KEY (reversed_by) REFERENCES users(id)
+	);
+
+	-- Append-only: see ledger.go. user_id has no foreign key so entries
+	-- survive the user being deleted.
+	CREATE TABLE IF NOT EXISTS points_ledger (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ward_id INTEGER NOT NULL,
+		submission_id INTEGER,
+		entry_type TEXT NOT NULL CHECK(entry_type IN ('submitted', 'amended', 'withdrawn', 'approved', 'rejected', 'reversed', 'adjustment')),
+		verified_delta INTEGER NOT NULL DEFAULT 0,
+		pending_delta INTEGER NOT NULL DEFAULT 0,
+		user_id INTEGER,
+		note TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (ward_id) REFERENCES wards(id),
-		FOREIGN KEY (approved_by) REFERENCES users(id)
+		FOREIGN KEY (submission_id) REFERENCES point_submissions(id)
+	);
+
+	-- Changes submitters make to their own pending submissions
+	CREATE TABLE IF NOT EXISTS submission_edits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		submission_id INTEGER NOT NULL,
+		action TEXT NOT NULL CHECK(action IN ('amended', 'withdrawn')),
+		old_points INTEGER NOT NULL,
+		new_points INTEGER NOT NULL,
+		old_note TEXT,
+		new_note TEXT,
+		old_items TEXT, -- JSON line items before and after; NULL if un-itemized
+		new_items TEXT,
+		ip_address TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (submission_id) REFERENCES point_submissions(id)
+	);
+
+	-- Line items of itemized submissions; see ordinances.go
+	CREATE TABLE IF NOT EXISTS submission_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		submission_id INTEGER NOT NULL,
+		category TEXT NOT NULL,
+		quantity INTEGER NOT NULL CHECK(quantity > 0),
+		points_each INTEGER NOT NULL,
+		family_names INTEGER NOT NULL DEFAULT 0,
+		bonus_points INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (submission_id) REFERENCES point_submissions(id)
+	);
+
+	-- Questions from approvers and replies from submitters. Submitters have
+	-- no account, so their comments have no user_id.
+	CREATE TABLE IF NOT EXISTS submission_comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		submission_id INTEGER NOT NULL,
+		user_id INTEGER,
+		from_submitter INTEGER NOT NULL DEFAULT 0,
+		author_name TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (submission_id) REFERENCES point_submissions(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
 	);
 
+	CREATE TRIGGER IF NOT EXISTS points_ledger_no_update
+	BEFORE UPDATE ON points_ledger
+	BEGIN
+		SELECT RAISE(ABORT, 'points_ledger is append-only');
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS points_ledger_no_delete
+	BEFORE DELETE ON points_ledger
+	BEGIN
+		SELECT RAISE(ABORT, 'points_ledger is append-only');
+	END;
+
 	CREATE TABLE IF NOT EXISTS achievements (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		ward_id INTEGER NOT NULL,
@@ -75,7 +210,7 @@ func createTables(db *sql.DB) error {
 
 	CREATE TABLE IF NOT EXISTS activity_logs (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		ward_id INTEGER NOT NULL,
+		ward_id INTEGER,
 		user_id INTEGER,
 		action TEXT NOT NULL,
 		details TEXT,
@@ -85,17 +220,528 @@ func createTables(db *sql.DB) error {
 		FOREIGN KEY (user_id) REFERENCES users(id)
 	);
 
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		ip_address TEXT,
+		user_agent TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		two_factor_pending INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS magic_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		ip_address TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		expires_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS password_resets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		ip_address TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS invitations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		invited_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		accepted_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+
+	-- OIDC states and completed sign-ins that have been used, so their
+	-- cookies can't be replayed; rows go once they'd have expired anyway
+	CREATE TABLE IF NOT EXISTS oidc_used_tokens (
+		token_hash TEXT PRIMARY KEY,
+		expires_at DATETIME NOT NULL
+	);
+
+	-- The wards a ward-scoped role will cover once the invitation is accepted
+	CREATE TABLE IF NOT EXISTS invitation_wards (
+		invitation_id INTEGER NOT NULL,
+		ward_id INTEGER NOT NULL,
+		PRIMARY KEY (invitation_id, ward_id),
+		FOREIGN KEY (invitation_id) REFERENCES invitations(id) ON DELETE CASCADE,
+		FOREIGN KEY (ward_id) REFERENCES wards(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS login_throttles (
+		key TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at DATETIME NOT NULL,
+		locked_until DATETIME
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_submissions_status ON point_submissions(status);
 	CREATE INDEX IF NOT EXISTS idx_submissions_ward ON point_submissions(ward_id);
 	CREATE INDEX IF NOT EXISTS idx_achievements_ward ON achievements(ward_id);
 	CREATE INDEX IF NOT EXISTS idx_activity_ward ON activity_logs(ward_id);
 	CREATE INDEX IF NOT EXISTS idx_activity_created ON activity_logs(created_at);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
+	CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets(user_id);
+	CREATE INDEX IF NOT EXISTS idx_magic_links_user ON magic_links(user_id);
+	CREATE INDEX IF NOT EXISTS idx_points_ledger_ward ON points_ledger(ward_id);
+	CREATE INDEX IF NOT EXISTS idx_points_ledger_submission ON points_ledger(submission_id);
+	CREATE INDEX IF NOT EXISTS idx_submission_edits_submission ON submission_edits(submission_id);
+	CREATE INDEX IF NOT EXISTS idx_submission_comments_submission ON submission_comments(submission_id);
+	CREATE INDEX IF NOT EXISTS idx_submission_items_submission ON submission_items(submission_id);
+	CREATE INDEX IF NOT EXISTS idx_invitations_email ON invitations(email);
+	CREATE INDEX IF NOT EXISTS idx_user_wards_ward ON user_wards(ward_id);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
 	`
 
 	_, err := db.Exec(schema)
 	return err
 }
 
+// migrateDB brings databases created by older versions up to the current
+// schema. Each step checks whether it is needed, so it is safe to run on
+// every start.
+func migrateDB(db *sql.DB) error {
+	if err := migrateActivityLogWardNullable(db); err != nil {
+		return err
+	}
+
+	// Columns added after their table was first created
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"users", "totp_secret", "TEXT"},
+		{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_last_counter", "INTEGER NOT NULL DEFAULT 0"},
+		{"sessions", "two_factor_pending", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"point_submissions", "submitted_by", "INTEGER REFERENCES users(id)"},
+		{"point_submissions", "reversed_by", "INTEGER REFERENCES users(id)"},
+		{"point_submissions", "reversed_at", "DATETIME"},
+		{"point_submissions", "reversal_reason", "TEXT"},
+		{"point_submissions", "awarded_points", "INTEGER"},
+		{"point_submissions", "approval_note", "TEXT"},
+		{"point_submissions", "rejection_reason", "TEXT"},
+		{"point_submissions", "edit_token_hash", "TEXT"},
+		{"point_submissions", "activity_date", "TEXT"},
+		{"point_submissions", "version", "INTEGER NOT NULL DEFAULT 1"},
+		{"submission_items", "family_names", "INTEGER NOT NULL DEFAULT 0"},
+		{"submission_items", "bonus_points", "INTEGER NOT NULL DEFAULT 0"},
+		{"submission_edits", "old_items", "TEXT"},
+		{"submission_edits", "new_items", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	// Approvals from before partial approval awarded everything claimed
+	_, err := db.Exec(`
+		UPDATE point_submissions SET awarded_points = points
+		WHERE status = 'approved' AND awarded_points IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("backfilling awarded points: %w", err)
+	}
+
+	// Submissions from before activity dates were visits on the day entered
+	_, err = db.Exec(`
+		UPDATE point_submissions SET activity_date = DATE(created_at, 'localtime')
+		WHERE activity_date IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("backfilling activity dates: %w", err)
+	}
+
+	if err := migrateSubmissionStatuses(db); err != nil {
+		return err
+	}
+
+	// Indexes on columns that older databases only have once migrated
+	_, err = db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_submissions_edit_token ON point_submissions(edit_token_hash)
+	`)
+	if err != nil {
+		return fmt.Errorf("creating indexes: %w", err)
+	}
+
+	if err := migrateUserWards(db); err != nil {
+		return err
+	}
+
+	if err := migrateLedgerEntryTypes(db); err != nil {
+		return err
+	}
+
+	if err := migrateInvitationWards(db); err != nil {
+		return fmt.Errorf("moving invitation wards: %w", err)
+	}
+
+	if err := backfillLedger(db); err != nil {
+		return fmt.Errorf("backfilling points ledger: %w", err)
+	}
+
+	return nil
+}
+
+// lookupColumn reports whether a column exists and whether it was declared
+// NOT NULL.
+func lookupColumn(db *sql.DB, table, column string) (exists, notNull bool, err error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, nn, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &nn, &defaultValue, &pk); err != nil {
+			return false, false, err
+		}
+		if name == column {
+			return true, nn == 1, nil
+		}
+	}
+
+	return false, false, rows.Err()
+}
+
+// missingSchema lists what createTables and migrateDB would add to db: whole
+// tables, columns, and columns that must allow NULL but don't. It's empty
+// once db has been migrated to this version.
+func missingSchema(db *sql.DB) ([]string, error) {
+	current, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer current.Close()
+
+	// Each connection to :memory: is a separate database
+	current.SetMaxOpenConns(1)
+	if err := createTables(current); err != nil {
+		return nil, err
+	}
+
+	rows, err := current.Query(`
+		SELECT m.name, c.name, c."notnull"
+		FROM sqlite_master m, pragma_table_info(m.name) c
+		WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%'
+		ORDER BY m.name, c.cid
+	`)
+	if err != nil {
+		return nil, err
+	}
+	type column struct {
+		table, name string
+		notNull     bool
+	}
+	var columns []column
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.table, &c.name, &c.notNull); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	missingTables := map[string]bool{}
+	for _, c := range columns {
+		if missingTables[c.table] {
+			continue
+		}
+
+		var tableExists bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)`,
+			c.table).Scan(&tableExists)
+		if err != nil {
+			return nil, err
+		}
+		if !tableExists {
+			missingTables[c.table] = true
+			missing = append(missing, "table "+c.table)
+			continue
+		}
+
+		exists, notNull, err := lookupColumn(db, c.table, c.name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !exists:
+			missing = append(missing, c.table+"."+c.name)
+		case notNull && !c.notNull:
+			missing = append(missing, c.table+"."+c.name+" allowing NULL")
+		}
+	}
+	return missing, nil
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, _, err := lookupColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// migrateInvitationWards copies the single ward_id that invitations carried
+// before invitation_wards into it. The old column is left in place, unused.
+func migrateInvitationWards(db *sql.DB) error {
+	exists, _, err := lookupColumn(db, "invitations", "ward_id")
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT OR IGNORE INTO invitation_wards (invitation_id, ward_id)
+		SELECT id, ward_id FROM invitations WHERE ward_id IS NOT NULL
+	`)
+	return err
+}
+
+// migrateActivityLogWardNullable rebuilds activity_logs so that ward_id can be
+// NULL for stake-wide events (logins, user administration). Rows written with
+// the old ward_id = 0 placeholder become NULL.
+func migrateActivityLogWardNullable(db *sql.DB) error {
+	_, notNull, err := lookupColumn(db, "activity_logs", "ward_id")
+	if err != nil || !notNull {
+		return err
+	}
+
+	statements := []string{
+		`CREATE TABLE activity_logs_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ward_id INTEGER,
+			user_id INTEGER,
+			action TEXT NOT NULL,
+			details TEXT,
+			points INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (ward_id) REFERENCES wards(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`INSERT INTO activity_logs_new (id, ward_id, user_id, action, details, points, created_at)
+			SELECT id, NULLIF(ward_id, 0), user_id, action, details, points, created_at
+			FROM activity_logs`,
+		`DROP TABLE activity_logs`,
+		`ALTER TABLE activity_logs_new RENAME TO activity_logs`,
+		`CREATE INDEX IF NOT EXISTS idx_activity_ward ON activity_logs(ward_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_activity_created ON activity_logs(created_at)`,
+	}
+	if err := rebuildTable(db, statements); err != nil {
+		return err
+	}
+
+	log.Println("Migrated activity_logs.ward_id to allow stake-wide entries")
+	return nil
+}
+
+// migrateUserWards moves each user's single users.ward_id into user_wards and
+// rebuilds users without that column and with the wider role CHECK.
+func migrateUserWards(db *sql.DB) error {
+	exists, _, err := lookupColumn(db, "users", "ward_id")
+	if err != nil || !exists {
+		return err
+	}
+
+	statements := []string{
+		`INSERT OR IGNORE INTO user_wards (user_id, ward_id)
+			SELECT id, ward_id FROM users WHERE ward_id IS NOT NULL AND role != 'admin'`,
+		`CREATE TABLE users_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT NOT NULL UNIQUE,
+			password TEXT NOT NULL,
+			role TEXT NOT NULL CHECK(role IN ('admin', 'stake_viewer', 'clerk', 'ward_approver')),
+			totp_secret TEXT,
+			totp_enabled INTEGER NOT NULL DEFAULT 0,
+			totp_last_counter INTEGER NOT NULL DEFAULT 0,
+			disabled INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`INSERT INTO users_new (id, email, password, role, totp_secret, totp_enabled,
+				totp_last_counter, disabled, created_at)
+			SELECT id, email, password, role, totp_secret, totp_enabled,
+				totp_last_counter, disabled, created_at
+			FROM users`,
+		`DROP TABLE users`,
+		`ALTER TABLE users_new RENAME TO users`,
+	}
+	if err := rebuildTable(db, statements); err != nil {
+		return err
+	}
+
+	log.Println("Migrated users.ward_id to user_wards")
+	return nil
+}
+
+// migrateLedgerEntryTypes rebuilds points_ledger with the current list of
+// entry types in its CHECK constraint. The table is append-only, so its
+// triggers are recreated along with it.
+func migrateLedgerEntryTypes(db *sql.DB) error {
+	var definition string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'points_ledger'`).Scan(&definition)
+	if err != nil || strings.Contains(definition, "'withdrawn'") {
+		return err
+	}
+
+	statements := []string{
+		`CREATE TABLE points_ledger_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ward_id INTEGER NOT NULL,
+			submission_id INTEGER,
+			entry_type TEXT NOT NULL CHECK(entry_type IN ('submitted', 'amended', 'withdrawn', 'approved', 'rejected', 'reversed', 'adjustment')),
+			verified_delta INTEGER NOT NULL DEFAULT 0,
+			pending_delta INTEGER NOT NULL DEFAULT 0,
+			user_id INTEGER,
+			note TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (ward_id) REFERENCES wards(id),
+			FOREIGN KEY (submission_id) REFERENCES point_submissions(id)
+		)`,
+		`INSERT INTO points_ledger_new (id, ward_id, submission_id, entry_type, verified_delta,
+				pending_delta, user_id, note, created_at)
+			SELECT id, ward_id, submission_id, entry_type, verified_delta,
+				pending_delta, user_id, note, created_at
+			FROM points_ledger`,
+		`DROP TABLE points_ledger`,
+		`ALTER TABLE points_ledger_new RENAME TO points_ledger`,
+		`CREATE INDEX IF NOT EXISTS idx_points_ledger_ward ON points_ledger(ward_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_points_ledger_submission ON points_ledger(submission_id)`,
+		`CREATE TRIGGER IF NOT EXISTS points_ledger_no_update
+		BEFORE UPDATE ON points_ledger
+		BEGIN
+			SELECT RAISE(ABORT, 'points_ledger is append-only');
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS points_ledger_no_delete
+		BEFORE DELETE ON points_ledger
+		BEGIN
+			SELECT RAISE(ABORT, 'points_ledger is append-only');
+		END`,
+	}
+	if err := rebuildTable(db, statements); err != nil {
+		return err
+	}
+
+	log.Println("Migrated points_ledger to allow new entry types")
+	return nil
+}
+
+// submissionStatusCheck is the status constraint on point_submissions, as
+// written in createTables.
+const submissionStatusCheck = "CHECK(status IN ('pending', 'needs_info', 'approved', 'rejected', 'withdrawn'))"
+
+var statusCheckPattern = regexp.MustCompile(`CHECK\s*\(\s*status IN \([^)]*\)\s*\)`)
+
+// migrateSubmissionStatuses widens the status CHECK on point_submissions for
+// databases created before the newer statuses existed. The table is rebuilt
+// from its own stored definition so every other column is kept as it is.
+func migrateSubmissionStatuses(db *sql.DB) error {
+	var definition string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'point_submissions'`).Scan(&definition)
+	if err != nil || strings.Contains(definition, submissionStatusCheck) {
+		return err
+	}
+
+	if !statusCheckPattern.MatchString(definition) {
+		return fmt.Errorf("point_submissions has no status constraint to update")
+	}
+	definition = statusCheckPattern.ReplaceAllLiteralString(definition, submissionStatusCheck)
+	definition = strings.Replace(definition, "point_submissions", "point_submissions_new", 1)
+
+	statements := []string{
+		definition,
+		`INSERT INTO point_submissions_new SELECT * FROM point_submissions`,
+		`DROP TABLE point_submissions`,
+		`ALTER TABLE point_submissions_new RENAME TO point_submissions`,
+		`CREATE INDEX IF NOT EXISTS idx_submissions_status ON point_submissions(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_submissions_ward ON point_submissions(ward_id)`,
+	}
+	if err := rebuildTable(db, statements); err != nil {
+		return err
+	}
+
+	log.Println("Migrated point_submissions to allow new statuses")
+	return nil
+}
+
+// rebuildTable runs statements that recreate a table in a single transaction.
+// SQLite can't alter a column in place, and foreign keys have to be off while
+// the old table is dropped and the new one renamed into its place.
+func rebuildTable(db *sql.DB, statements []string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func seedData(db *sql.DB) error {
 	// Check if wards already exist
 	var count int
@@ -165,8 +811,8 @@ func seedData(db *sql.DB) error {
 
 	for _, sub := range sampleSubmissions {
 		_, err := db.Exec(
-			`INSERT INTO point_submissions (ward_id, submitter_name, points, note, status, approved_at) 
-			VALUES (?, ?, ?, ?, ?, ?)`,
+			`INSERT INTO point_submissions (ward_id, submitter_name, points, note, status, approved_at, awarded_points, activity_date)
+			VALUES (?, ?, ?, ?, ?, ?, CASE WHEN ? = 'approved' THEN ? END, ?)`,
 			sub.wardID, "Demo User", sub.points, "Initial seed data", sub.status,
 			func() *time.Time {
 				if sub.status == "approved" {
@@ -175,6 +821,7 @@ func seedData(db *sql.DB) error {
 				}
 				return nil
 			}(),
+			sub.status, sub.points, today(),
 		)
 		if err != nil {
 			log.Printf("Error inserting sample submission: %v", err)
@@ -185,7 +832,7 @@ func seedData(db *sql.DB) error {
 	_, err = db.Exec(`
 		UPDATE wards 
 		SET points = (
-			SELECT COALESCE(SUM(points), 0) 
+			SELECT COALESCE(SUM(awarded_points), 0) 
 			FROM point_submissions 
 			WHERE ward_id = wards.id AND status = 'approved'
 		),
@@ -199,6 +846,11 @@ func seedData(db *sql.DB) error {
 		return fmt.Errorf("failed to update ward points: %w", err)
 	}
 
+	// Record the sample submissions in the points ledger
+	if err := backfillLedger(db); err != nil {
+		return fmt.Errorf("failed to record ward points: %w", err)
+	}
+
 	// Add some achievements
 	achievements := []struct {
 		wardID int
@@ -228,4 +880,18 @@ func seedData(db *sql.DB) error {
 
 	log.Println("Database seeded successfully")
 	return nil
-}
\ No newline at end of file
+}
+
+func getSetting(db *sql.DB, key string) (string, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	return value, err
+}
+
+func setSetting(db *sql.DB, key, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP
+	`, key, value)
+	return err
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -20,8 +22,15 @@ func (s *Server) handleGetLeaderboard(w http.ResponseWriter, r *http.Request) {
 		sortBy = "verified-desc"
 	}
 
+	// Rank on one ordinance category rather than overall points
+	category := r.URL.Query().Get("category")
+	if _, ok := categoryNames(s.ordinanceCategories())[category]; category != "" && !ok {
+		http.Error(w, "Unknown ordinance category", http.StatusBadRequest)
+		return
+	}
+
 	// Get leaderboard entries
-	entries, err := s.getLeaderboardEntries(sortBy)
+	entries, err := s.getLeaderboardEntries(sortBy, category)
 	if err != nil {
 		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
 		log.Printf("Error getting leaderboard: %v", err)
@@ -38,12 +47,17 @@ func (s *Server) handleGetLeaderboard(w http.ResponseWriter, r *http.Request) {
 		"leaderboard": entries,
 		"stats":       stats,
 	}
+	if category != "" {
+		response["category"] = category
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) getLeaderboardEntries(sortBy string) ([]LeaderboardEntry, error) {
+// getLeaderboardEntries ranks the wards. With a category, the points sorts
+// rank on how many of that ordinance each ward has had approved instead.
+func (s *Server) getLeaderboardEntries(sortBy, category string) ([]LeaderboardEntry, error) {
 	query := `
 		SELECT
 			w.id,
@@ -55,22 +69,47 @@ func (s *Server) getLeaderboardEntries(sortBy string) ([]LeaderboardEntry, error
 		FROM wards w
 	`
 
-	switch sortBy {
-	case "verified-asc":
+	var args []interface{}
+	if category != "" {
+		query += `
+		LEFT JOIN (
+			SELECT p.ward_id,
+			       SUM(i.quantity) as quantity,
+			       SUM(i.quantity * i.points_each + i.bonus_points) as points
+			FROM submission_items i
+			JOIN point_submissions p ON p.id = i.submission_id
+			WHERE p.status = 'approved' AND i.category = ?
+			GROUP BY p.ward_id
+		) c ON c.ward_id = w.id
+		`
+		args = append(args, category)
+	}
+
+	switch {
+	case sortBy == "ward-asc":
+		query += " ORDER BY w.name ASC"
+	case sortBy == "ward-desc":
+		query += " ORDER BY w.name DESC"
+	case category != "" && strings.HasSuffix(sortBy, "-asc"):
+		query += " ORDER BY COALESCE(c.quantity, 0) ASC, COALESCE(c.points, 0) ASC, w.name ASC"
+	case category != "":
+		query += " ORDER BY COALESCE(c.quantity, 0) DESC, COALESCE(c.points, 0) DESC, w.name ASC"
+	case sortBy == "verified-asc":
 		query += " ORDER BY w.points ASC"
-	case "total-desc":
+	case sortBy == "total-desc":
 		query += " ORDER BY total_points DESC"
-	case "total-asc":
+	case sortBy == "total-asc":
 		query += " ORDER BY total_points ASC"
-	case "ward-asc":
-		query += " ORDER BY w.name ASC"
-	case "ward-desc":
-		query += " ORDER BY w.name DESC"
 	default: // verified-desc
 		query += " ORDER BY w.points DESC"
 	}
 
-	rows, err := s.db.Query(query)
+	categories, err := s.categoryTotals(0)
+	if err != nil {
+		log.Printf("Error totaling categories: %v", err)
+	}
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -106,6 +145,11 @@ func (s *Server) getLeaderboardEntries(sortBy string) ([]LeaderboardEntry, error
 		// Calculate streak (simplified for now)
 		entry.Streak = s.calculateStreak(entry.WardID)
 
+		entry.Categories = categories[entry.WardID]
+		if category != "" {
+			entry.Category = findCategoryTotal(entry.Categories, category)
+		}
+
 		entries = append(entries, entry)
 	}
 
@@ -133,15 +177,18 @@ func (s *Server) getWardAchievements(wardID int) ([]string, error) {
 }
 
 func (s *Server) calculateStreak(wardID int) int {
-	// Simplified streak calculation - counts consecutive days with activity
+	// Simplified streak calculation - counts days in the last week (today
+	// and the six before it) with an approved temple visit. Unreviewed
+	// submissions don't count, since anyone can back-date one.
 	var streak int
 	query := `
-		SELECT COUNT(DISTINCT DATE(created_at)) as streak
-		FROM activity_logs
+		SELECT COUNT(DISTINCT activity_date) as streak
+		FROM point_submissions
 		WHERE ward_id = ?
-		AND created_at >= datetime('now', '-7 days')
+		AND status = 'approved'
+		AND activity_date > ?
 	`
-	s.db.QueryRow(query, wardID).Scan(&streak)
+	s.db.QueryRow(query, wardID, time.Now().AddDate(0, 0, -7).Format(activityDateLayout)).Scan(&streak)
 	return streak
 }
 
@@ -164,13 +211,15 @@ func (s *Server) getStats() (*Stats, error) {
 		return stats, err
 	}
 
-	// Calculate days active (from first submission)
-	var firstSubmission time.Time
+	// Calculate days active (from the first approved visit)
+	var firstVisit sql.NullString
 	err = s.db.QueryRow(`
-		SELECT MIN(created_at) FROM point_submissions WHERE status = 'approved'
-	`).Scan(&firstSubmission)
-	if err == nil {
-		stats.DaysActive = int(time.Since(firstSubmission).Hours() / 24)
+		SELECT MIN(activity_date) FROM point_submissions WHERE status = 'approved'
+	`).Scan(&firstVisit)
+	if err == nil && firstVisit.Valid {
+		if first, err := time.ParseInLocation(activityDateLayout, firstVisit.String, time.Local); err == nil {
+			stats.DaysActive = int(time.Since(first).Hours() / 24)
+		}
 	}
 
 	// Count unique participants
@@ -178,15 +227,25 @@ func (s *Server) getStats() (*Stats, error) {
 		SELECT COUNT(DISTINCT submitter_name) FROM point_submissions
 	`).Scan(&stats.Participants)
 
+	// Family history work among approved ordinances
+	err = s.db.QueryRow(`
+		SELECT COALESCE(SUM(i.quantity), 0), COALESCE(SUM(i.bonus_points), 0)
+		FROM submission_items i
+		JOIN point_submissions p ON p.id = i.submission_id
+		WHERE p.status = 'approved' AND i.family_names = 1
+	`).Scan(&stats.FamilyNames, &stats.FamilyBonusPoints)
+
 	return stats, nil
 }
 
 func (s *Server) handleSubmitPoints(w http.ResponseWriter, r *http.Request) {
 	var submission struct {
-		WardID        int    `json:"ward_id"`
-		SubmitterName string `json:"submitter_name"`
-		Points        int    `json:"points"`
-		Note          string `json:"note"`
+		WardID        int              `json:"ward_id"`
+		SubmitterName string           `json:"submitter_name"`
+		Points        int              `json:"points"`
+		Note          string           `json:"note"`
+		Items         []SubmissionItem `json:"items"`
+		ActivityDate  string           `json:"activity_date"` // defaults to today
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
@@ -194,17 +253,67 @@ func (s *Server) handleSubmitPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	activityDate, err := s.competitionDates().checkActivityDate(submission.ActivityDate)
+	if err != nil {
+		http.Error(w, "Invalid activity date: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Itemized submissions are worth what the catalog says, whatever points
+	// the client sent. Only an admin can allow points without items.
+	var items []SubmissionItem
+	switch {
+	case len(submission.Items) > 0:
+		var err error
+		items, submission.Points, err = priceItems(s.ordinanceCategories(), s.familyNameMultiplier(), submission.Items)
+		if err != nil {
+			http.Error(w, "Invalid items: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case !s.unitemizedAllowed():
+		http.Error(w, "List the ordinances completed; points are counted from them", http.StatusBadRequest)
+		return
+	}
+
 	// Validate input
 	if submission.WardID == 0 || submission.SubmitterName == "" || submission.Points <= 0 {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
+	if submission.Points > maxSubmissionPoints {
+		http.Error(w, fmt.Sprintf("A submission can be worth at most %d points", maxSubmissionPoints), http.StatusBadRequest)
+		return
+	}
+
+	// Submissions are normally anonymous. A signed-in clerk entering points
+	// on behalf of youth in their ward is recorded as the submitter.
+	var submittedBy *int
+	if userID := s.getUserIDFromSession(r); userID != 0 &&
+		s.hasPermission(userID, permCreateSubmissions, submission.WardID) {
+		submittedBy = &userID
+	}
+
+	// The receipt code lets the submitter change or withdraw the submission
+	// while it's pending; only its hash is stored
+	receiptCode, err := generateToken(18)
+	if err != nil {
+		http.Error(w, "Failed to submit points", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
 	// Insert submission
-	result, err := s.db.Exec(`
-		INSERT INTO point_submissions (ward_id, submitter_name, points, note)
-		VALUES (?, ?, ?, ?)
-	`, submission.WardID, submission.SubmitterName, submission.Points, submission.Note)
+	result, err := tx.Exec(`
+		INSERT INTO point_submissions (ward_id, submitter_name, points, note, submitted_by, edit_token_hash, activity_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, submission.WardID, submission.SubmitterName, submission.Points, submission.Note, submittedBy,
+		hashToken(receiptCode), activityDate)
 
 	if err != nil {
 		http.Error(w, "Failed to submit points", http.StatusInternalServerError)
@@ -213,24 +322,30 @@ func (s *Server) handleSubmitPoints(w http.ResponseWriter, r *http.Request) {
 	}
 
 	submissionID, _ := result.LastInsertId()
+	id := int(submissionID)
 
-	// Update pending points for the ward
-	_, err = s.db.Exec(`
-		UPDATE wards
-		SET pending_points = (
-			SELECT COALESCE(SUM(points), 0)
-			FROM point_submissions
-			WHERE ward_id = ? AND status = 'pending'
-		)
-		WHERE id = ?
-	`, submission.WardID, submission.WardID)
-
+	err = replaceSubmissionItems(tx, id, items)
+	if err == nil {
+		// Add to the ward's pending points
+		err = recordLedgerEntry(tx, LedgerEntry{
+			WardID:       submission.WardID,
+			SubmissionID: &id,
+			EntryType:    ledgerSubmitted,
+			PendingDelta: submission.Points,
+			UserID:       submittedBy,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		log.Printf("Error updating pending points: %v", err)
+		http.Error(w, "Failed to submit points", http.StatusInternalServerError)
+		log.Printf("Error submitting points: %v", err)
+		return
 	}
 
 	// Log activity
-	s.logActivity(submission.WardID, nil, "points_submitted",
+	s.logActivity(submission.WardID, submittedBy, "points_submitted",
 		fmt.Sprintf("%s submitted %d points", submission.SubmitterName, submission.Points),
 		submission.Points)
 
@@ -239,9 +354,14 @@ func (s *Server) handleSubmitPoints(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"id":      submissionID,
-		"message": "Points submitted successfully! Waiting for approval.",
+		"success":       true,
+		"id":            submissionID,
+		"points":        submission.Points,
+		"items":         items,
+		"activity_date": activityDate,
+		"receipt_code":  receiptCode,
+		"receipt_url":   s.baseURL(r) + "/receipt?code=" + receiptCode,
+		"message":       "Points submitted successfully! Waiting for approval.",
 	})
 }
 
@@ -260,60 +380,117 @@ func (s *Server) handleApprovePoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get submission details
-	var wardID, points int
-	var submitterName string
-	err = s.db.QueryRow(`
-		SELECT ward_id, points, submitter_name
-		FROM point_submissions
-		WHERE id = ? AND status = 'pending'
-	`, submissionID).Scan(&wardID, &points, &submitterName)
+	// The body is optional: without one the full claim is approved. Version
+	// is the submission's version the approver reviewed.
+	var req struct {
+		Points  *int   `json:"points"`
+		Note    string `json:"note"`
+		Version *int   `json:"version"`
+	}
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Submission not found or already processed", http.StatusNotFound)
-		} else {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	submission := s.loadSubmission(w, submissionID)
+	if submission == nil {
+		return
+	}
+
+	awarded := submission.Points
+	if req.Points != nil {
+		awarded = *req.Points
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	if awarded <= 0 {
+		http.Error(w, "Points awarded must be positive; reject the submission instead", http.StatusBadRequest)
+		return
+	}
+	if awarded > submission.Points {
+		http.Error(w, fmt.Sprintf("Points awarded can't be more than the %d claimed", submission.Points),
+			http.StatusBadRequest)
+		return
+	}
+	if awarded != submission.Points && req.Note == "" {
+		http.Error(w, "A note is required when awarding a different number of points", http.StatusBadRequest)
+		return
+	}
+
+	// Category totals and rankings count an itemized submission's items, so
+	// its points can only change along with them
+	if awarded != submission.Points {
+		itemized, err := submissionHasItems(s.db, submission.ID)
+		if err != nil {
+			log.Printf("Error loading submission items: %v", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if itemized {
+			http.Error(w, "Points for listed ordinances can't be adjusted; ask the submitter to correct the list instead",
+				http.StatusBadRequest)
+			return
 		}
-		return
 	}
 
 	// Check if user can approve for this ward
-	if !s.canApproveForWard(userID, wardID) {
+	if !s.canApproveForWard(userID, submission.WardID) {
 		http.Error(w, "Not authorized to approve for this ward", http.StatusForbidden)
 		return
 	}
 
-	// Approve the submission
-	_, err = s.db.Exec(`
-		UPDATE point_submissions
-		SET status = 'approved', approved_by = ?, approved_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, userID, submissionID)
+	if !submission.undecided() {
+		http.Error(w, fmt.Sprintf("Submission has already been %s", submission.Status), http.StatusConflict)
+		return
+	}
 
-	if err != nil {
-		http.Error(w, "Failed to approve submission", http.StatusInternalServerError)
+	if req.Version != nil && *req.Version != submission.Version {
+		http.Error(w, "The submitter has changed this submission; please review it again", http.StatusConflict)
 		return
 	}
 
-	// Update ward points
-	_, err = s.db.Exec(`
-		UPDATE wards
-		SET points = points + ?,
-		    pending_points = pending_points - ?
-		WHERE id = ?
-	`, points, points, wardID)
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
+	err = decideSubmission(tx, submission, userID, decision{
+		Status: "approved",
+		Points: awarded,
+		Note:   req.Note,
+	})
 	if err != nil {
-		log.Printf("Error updating ward points: %v", err)
+		if err == errSubmissionNotPending {
+			http.Error(w, "Submission was already processed by someone else", http.StatusConflict)
+		} else if err == errSubmissionAmended {
+			http.Error(w, "The submitter has changed this submission; please review it again", http.StatusConflict)
+		} else {
+			log.Printf("Error approving submission %d: %v", submission.ID, err)
+			http.Error(w, "Failed to approve submission", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to approve submission", http.StatusInternalServerError)
+		return
 	}
 
 	// Check for achievements
-	s.checkAndAwardAchievements(wardID)
+	s.checkAndAwardAchievements(submission.WardID)
 
 	// Log activity
-	s.logActivity(wardID, &userID, "points_approved",
-		fmt.Sprintf("Approved %d points from %s", points, submitterName), points)
+	details := fmt.Sprintf("Approved %d points from %s", awarded, submission.SubmitterName)
+	message := "Points approved successfully!"
+	if awarded != submission.Points {
+		details = fmt.Sprintf("Approved %d of %d points from %s: %s",
+			awarded, submission.Points, submission.SubmitterName, req.Note)
+		message = fmt.Sprintf("Approved %d of %d points", awarded, submission.Points)
+	}
+	s.logActivity(submission.WardID, &userID, "points_approved", details, awarded)
 
 	// Broadcast update
 	s.broadcastLeaderboardUpdate()
@@ -321,7 +498,7 @@ func (s *Server) handleApprovePoints(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
-		"message": "Points approved successfully!",
+		"message": message,
 	})
 }
 
@@ -339,43 +516,75 @@ func (s *Server) handleRejectPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get submission details
-	var wardID, points int
-	err = s.db.QueryRow(`
-		SELECT ward_id, points
-		FROM point_submissions
-		WHERE id = ? AND status = 'pending'
-	`, submissionID).Scan(&wardID, &points)
+	// One of the canned rejection reasons, or the approver's own words
+	var req struct {
+		Reason  string `json:"reason"`
+		Version *int   `json:"version"`
+	}
 
-	if err != nil {
-		http.Error(w, "Submission not found", http.StatusNotFound)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	submission := s.loadSubmission(w, submissionID)
+	if submission == nil {
 		return
 	}
 
 	// Check authorization
-	if !s.canApproveForWard(userID, wardID) {
+	if !s.canApproveForWard(userID, submission.WardID) {
 		http.Error(w, "Not authorized", http.StatusForbidden)
 		return
 	}
 
-	// Reject the submission
-	_, err = s.db.Exec(`
-		UPDATE point_submissions
-		SET status = 'rejected', approved_by = ?, approved_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, userID, submissionID)
+	if !submission.undecided() {
+		http.Error(w, fmt.Sprintf("Submission has already been %s", submission.Status), http.StatusConflict)
+		return
+	}
+
+	if req.Version != nil && *req.Version != submission.Version {
+		http.Error(w, "The submitter has changed this submission; please review it again", http.StatusConflict)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
+	err = decideSubmission(tx, submission, userID, decision{
+		Status: "rejected",
+		Reason: req.Reason,
+	})
 	if err != nil {
+		if err == errSubmissionNotPending {
+			http.Error(w, "Submission was already processed by someone else", http.StatusConflict)
+		} else if err == errSubmissionAmended {
+			http.Error(w, "The submitter has changed this submission; please review it again", http.StatusConflict)
+		} else {
+			log.Printf("Error rejecting submission %d: %v", submission.ID, err)
+			http.Error(w, "Failed to reject submission", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to reject submission", http.StatusInternalServerError)
 		return
 	}
 
-	// Update pending points
-	_, err = s.db.Exec(`
-		UPDATE wards
-		SET pending_points = pending_points - ?
-		WHERE id = ?
-	`, points, wardID)
+	s.logActivity(submission.WardID, &userID, "points_rejected",
+		fmt.Sprintf("Rejected %d points from %s: %s", submission.Points, submission.SubmitterName, req.Reason),
+		0)
 
 	// Broadcast update
 	s.broadcastLeaderboardUpdate()
@@ -387,6 +596,104 @@ func (s *Server) handleRejectPoints(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// loadSubmission loads a submission for a decision, writing a 404 and
+// returning nil if there's no such submission.
+func (s *Server) loadSubmission(w http.ResponseWriter, submissionID int) *PointSubmission {
+	submission, err := querySubmission(s.db, submissionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Submission not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return nil
+	}
+
+	return submission
+}
+
+// querySubmission loads the fields needed to decide on a submission.
+func querySubmission(q rowQuerier, submissionID int) (*PointSubmission, error) {
+	var submission PointSubmission
+	err := q.QueryRow(`
+		SELECT id, ward_id, points, awarded_points, submitter_name, status, version
+		FROM point_submissions
+		WHERE id = ?
+	`, submissionID).Scan(&submission.ID, &submission.WardID, &submission.Points,
+		&submission.AwardedPoints, &submission.SubmitterName, &submission.Status, &submission.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &submission, nil
+}
+
+var (
+	// errSubmissionNotPending means another approver decided the submission
+	// first.
+	errSubmissionNotPending = errors.New("submission is no longer pending")
+
+	// errSubmissionAmended means the submitter changed their claim after the
+	// approver loaded it.
+	errSubmissionAmended = errors.New("submission was amended")
+)
+
+// decision is an approver's ruling on a pending submission.
+type decision struct {
+	Status string // "approved" or "rejected"
+	Points int    // points awarded when approving, which may differ from the claim
+	Note   string // the approver's note on an approval
+	Reason string // why it was rejected
+}
+
+// decideSubmission approves or rejects a pending submission inside tx and
+// records in the ledger that its claimed points leave the ward's pending
+// total (and the awarded points join its verified total when approved). The
+// status change only applies while the submission is still pending, so when
+// two approvers act at once exactly one wins and the other gets
+// errSubmissionNotPending. If the submitter changed it in any way since
+// submission.Version, nothing changes and errSubmissionAmended is returned.
+func decideSubmission(tx *sql.Tx, submission *PointSubmission, userID int, d decision) error {
+	var awarded *int
+	if d.Status == "approved" {
+		awarded = &d.Points
+	}
+
+	result, err := tx.Exec(`
+		UPDATE point_submissions
+		SET status = ?, approved_by = ?, approved_at = CURRENT_TIMESTAMP,
+		    awarded_points = ?, approval_note = NULLIF(?, ''), rejection_reason = NULLIF(?, '')
+		WHERE id = ? AND status IN ('pending', 'needs_info') AND version = ?
+	`, d.Status, userID, awarded, d.Note, d.Reason, submission.ID, submission.Version)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		current, err := querySubmission(tx, submission.ID)
+		if err == nil && current.undecided() {
+			return errSubmissionAmended
+		}
+		return errSubmissionNotPending
+	}
+
+	entry := LedgerEntry{
+		WardID:       submission.WardID,
+		SubmissionID: &submission.ID,
+		EntryType:    ledgerRejected,
+		PendingDelta: -submission.Points,
+		UserID:       &userID,
+	}
+	if d.Status == "approved" {
+		entry.EntryType = ledgerApproved
+		entry.VerifiedDelta = d.Points
+		entry.Note = d.Note
+	} else {
+		entry.Note = d.Reason
+	}
+	return recordLedgerEntry(tx, entry)
+}
+
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var credentials struct {
 		Email    string `json:"email"`
@@ -398,49 +705,87 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse to even check the password while backing off or locked out
+	ip := clientIP(r)
+	if !s.checkLoginThrottle(w, credentials.Email, ip) {
+		return
+	}
+
 	var user User
 	var hashedPassword string
 	err := s.db.QueryRow(`
-		SELECT id, email, password, role, ward_id
+		SELECT id, email, password, role, totp_enabled, disabled
 		FROM users
 		WHERE email = ?
-	`, credentials.Email).Scan(&user.ID, &user.Email, &hashedPassword, &user.Role, &user.WardID)
+	`, credentials.Email).Scan(&user.ID, &user.Email, &hashedPassword, &user.Role,
+		&user.TwoFactorEnabled, &user.Disabled)
 
 	if err != nil {
+		s.handleLoginFailure(credentials.Email, ip)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(credentials.Password)); err != nil {
+		s.handleLoginFailure(credentials.Email, ip)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Create session (simplified - in production use proper session management)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    fmt.Sprintf("%d", user.ID),
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   86400, // 24 hours
-	})
+	if err := s.clearLoginFailures(emailThrottleKey(credentials.Email)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	s.finishLogin(w, r, user)
+}
+
+// finishLogin is called once a user's password (or other primary credential)
+// has been verified. Users with 2FA enabled get a challenge to complete at
+// /api/login/2fa instead of a session; users whose role requires 2FA but who
+// haven't enrolled get a session that can only be used to enroll. Disabled
+// accounts are refused.
+func (s *Server) finishLogin(w http.ResponseWriter, r *http.Request, user User) {
+	if user.Disabled {
+		http.Error(w, "This account has been disabled", http.StatusForbidden)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":             true,
+			"two_factor_required": true,
+			"challenge":           s.newTwoFactorChallenge(user.ID),
+		})
+		return
+	}
+
+	setupRequired := s.twoFactorRequired(user.Role)
+
+	// Create session
+	if err := s.createSession(w, r, user.ID, setupRequired); err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"user":    user,
+		"success":                   true,
+		"user":                      user,
+		"two_factor_setup_required": setupRequired,
 	})
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   -1,
-	})
+	// Revoke the server-side session so the cookie can't be replayed
+	if session := s.getSession(r); session != nil {
+		if err := s.revokeSession(session.ID); err != nil {
+			log.Printf("Error revoking session: %v", err)
+		}
+	}
+	clearSessionCookie(w)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -456,17 +801,13 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	err := s.db.QueryRow(`
-		SELECT id, email, role, ward_id
-		FROM users
-		WHERE id = ?
-	`, userID).Scan(&user.ID, &user.Email, &user.Role, &user.WardID)
-
+	user, err := s.loadUser(userID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	user.StakeWide = roleDefinitions[user.Role].StakeWide
+	user.Permissions = userPermissions(user.Role)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
@@ -492,10 +833,12 @@ func (s *Server) handleGetWardLog(w http.ResponseWriter, r *http.Request) {
 
 	// Get all submissions for this ward
 	query := `
-		SELECT id, submitter_name, points, note, status, created_at
+		SELECT id, submitter_name, points, awarded_points, COALESCE(approval_note, ''),
+		       COALESCE(rejection_reason, ''), note, status, created_at, reversed_at,
+		       COALESCE(reversal_reason, ''), COALESCE(activity_date, '')
 		FROM point_submissions
 		WHERE ward_id = ?
-		ORDER BY created_at DESC
+		ORDER BY activity_date DESC, created_at DESC
 	`
 
 	rows, err := s.db.Query(query, wardID)
@@ -509,8 +852,9 @@ func (s *Server) handleGetWardLog(w http.ResponseWriter, r *http.Request) {
 	var submissions []PointSubmission
 	for rows.Next() {
 		var sub PointSubmission
-		err := rows.Scan(&sub.ID, &sub.SubmitterName, &sub.Points,
-			&sub.Note, &sub.Status, &sub.CreatedAt)
+		err := rows.Scan(&sub.ID, &sub.SubmitterName, &sub.Points, &sub.AwardedPoints,
+			&sub.ApprovalNote, &sub.RejectionReason, &sub.Note, &sub.Status, &sub.CreatedAt,
+			&sub.ReversedAt, &sub.ReversalReason, &sub.ActivityDate)
 		if err != nil {
 			log.Printf("Error scanning submission: %v", err)
 			continue
@@ -518,11 +862,22 @@ func (s *Server) handleGetWardLog(w http.ResponseWriter, r *http.Request) {
 		submissions = append(submissions, sub)
 	}
 
+	if err := s.attachSubmissionItems(submissions); err != nil {
+		log.Printf("Error loading submission items: %v", err)
+	}
+
+	id, _ := strconv.Atoi(wardID)
+	categories, err := s.categoryTotals(id)
+	if err != nil {
+		log.Printf("Error totaling ward categories: %v", err)
+	}
+
 	response := map[string]interface{}{
 		"ward_id":        wardID,
 		"ward_name":      wardName,
 		"total_points":   totalPoints,
 		"pending_points": pendingPoints,
+		"categories":     categories[id],
 		"submissions":    submissions,
 	}
 
@@ -542,50 +897,44 @@ func (s *Server) handleGetSubmissions(w http.ResponseWriter, r *http.Request) {
 		status = "pending"
 	}
 
-	// Check user role and ward
-	var role string
-	var userWardID sql.NullInt64
-	err := s.db.QueryRow(`
-		SELECT role, ward_id FROM users WHERE id = ?
-	`, userID).Scan(&role, &userWardID)
-
+	// Find which wards this user may see
+	allWards, wardIDs, err := s.permittedWards(userID, permViewSubmissions)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	var query string
-	var args []interface{}
-
-	if role == "admin" {
-		// Admin can see all submissions
-		query = `
-			SELECT ps.id, ps.ward_id, w.name, ps.submitter_name, ps.points,
-			       ps.note, ps.status, ps.created_at
-			FROM point_submissions ps
-			JOIN wards w ON ps.ward_id = w.id
-			WHERE ps.status = ?
-			ORDER BY ps.created_at DESC
-			LIMIT 50
-		`
-		args = []interface{}{status}
-	} else if role == "ward_approver" && userWardID.Valid {
-		// Ward approver can only see their ward's submissions
-		query = `
-			SELECT ps.id, ps.ward_id, w.name, ps.submitter_name, ps.points,
-			       ps.note, ps.status, ps.created_at
-			FROM point_submissions ps
-			JOIN wards w ON ps.ward_id = w.id
-			WHERE ps.status = ? AND ps.ward_id = ?
-			ORDER BY ps.created_at DESC
-			LIMIT 50
-		`
-		args = []interface{}{status, userWardID.Int64}
-	} else {
+	if !allWards && len(wardIDs) == 0 {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
+	query := `
+		SELECT ps.id, ps.ward_id, w.name, ps.submitter_name, ps.points, ps.awarded_points,
+		       COALESCE(ps.approval_note, ''), COALESCE(ps.rejection_reason, ''),
+		       ps.note, ps.status, ps.created_at, COALESCE(ps.activity_date, ''), ps.version,
+		       (SELECT COUNT(*) FROM submission_edits WHERE submission_id = ps.id),
+		       (SELECT COUNT(*) FROM submission_comments WHERE submission_id = ps.id)
+		FROM point_submissions ps
+		JOIN wards w ON ps.ward_id = w.id
+		WHERE ps.status = ?
+	`
+	args := []interface{}{status}
+
+	if !allWards {
+		placeholders := make([]string, len(wardIDs))
+		for i, id := range wardIDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		query += ` AND ps.ward_id IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+
+	query += `
+		ORDER BY ps.created_at DESC
+		LIMIT 50
+	`
+
 	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -598,7 +947,8 @@ func (s *Server) handleGetSubmissions(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var sub PointSubmission
 		err := rows.Scan(&sub.ID, &sub.WardID, &sub.WardName, &sub.SubmitterName,
-			&sub.Points, &sub.Note, &sub.Status, &sub.CreatedAt)
+			&sub.Points, &sub.AwardedPoints, &sub.ApprovalNote, &sub.RejectionReason,
+			&sub.Note, &sub.Status, &sub.CreatedAt, &sub.ActivityDate, &sub.Version, &sub.EditCount, &sub.CommentCount)
 		if err != nil {
 			log.Printf("Error scanning submission: %v", err)
 			continue
@@ -606,6 +956,10 @@ func (s *Server) handleGetSubmissions(w http.ResponseWriter, r *http.Request) {
 		submissions = append(submissions, sub)
 	}
 
+	if err := s.attachSubmissionItems(submissions); err != nil {
+		log.Printf("Error loading submission items: %v", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(submissions)
 }
@@ -615,10 +969,24 @@ func (s *Server) handleAuthStatus(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromSession(r)
 	
 	response := struct {
-		IsLoggedIn bool   `json:"isLoggedIn"`
-		UserRole   string `json:"userRole,omitempty"`
+		IsLoggedIn             bool   `json:"isLoggedIn"`
+		UserRole               string `json:"userRole,omitempty"`
+		CSRFToken              string `json:"csrfToken"`
+		TwoFactorSetupRequired bool   `json:"twoFactorSetupRequired,omitempty"`
+		OIDCProvider           string `json:"oidcProvider,omitempty"`
 	}{
 		IsLoggedIn: userID > 0,
+		CSRFToken:  s.csrfToken(w, r),
+	}
+
+	if s.oidc != nil {
+		response.OIDCProvider = s.oidc.name
+	}
+
+	if userID == 0 {
+		if session := s.getSession(r); session != nil && session.TwoFactorPending {
+			response.TwoFactorSetupRequired = true
+		}
 	}
 	
 	if userID > 0 {
@@ -633,7 +1001,7 @@ func (s *Server) handleAuthStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Create user endpoint (admin only - can create admins or ward approvers)
+// Create user endpoint (admin only - can create users in any role)
 func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	// Check if user is admin
 	userID := s.getUserIDFromSession(r)
@@ -642,9 +1010,7 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var userRole string
-	err := s.db.QueryRow(`SELECT role FROM users WHERE id = ?`, userID).Scan(&userRole)
-	if err != nil || userRole != "admin" {
+	if !s.isAdmin(userID) {
 		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
 		return
 	}
@@ -654,7 +1020,8 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 		Role     string `json:"role"`
-		WardID   int    `json:"ward_id"`
+		WardIDs  []int  `json:"ward_ids"`
+		WardID   int    `json:"ward_id"` // single-ward form, still accepted
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -668,15 +1035,14 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Validate role
-	if req.Role != "admin" && req.Role != "ward_approver" {
-		http.Error(w, "Invalid role - must be 'admin' or 'ward_approver'", http.StatusBadRequest)
-		return
+	if req.WardID > 0 {
+		req.WardIDs = append(req.WardIDs, req.WardID)
 	}
 	
-	// Ward approvers must have a ward assigned
-	if req.Role == "ward_approver" && req.WardID == 0 {
-		http.Error(w, "Ward is required for ward approvers", http.StatusBadRequest)
+	// Validate role and wards
+	wardIDs, msg := validateRoleAssignment(req.Role, req.WardIDs)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 	
@@ -687,19 +1053,18 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Create user
-	var result sql.Result
-	if req.Role == "admin" {
-		result, err = s.db.Exec(`
-			INSERT INTO users (email, password, role) 
-			VALUES (?, ?, ?)
-		`, req.Email, string(hashedPassword), req.Role)
-	} else {
-		result, err = s.db.Exec(`
-			INSERT INTO users (email, password, role, ward_id) 
-			VALUES (?, ?, ?, ?)
-		`, req.Email, string(hashedPassword), req.Role, req.WardID)
+	// Create user and their ward memberships together
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
+	defer tx.Rollback()
+	
+	result, err := tx.Exec(`
+		INSERT INTO users (email, password, role) 
+		VALUES (?, ?, ?)
+	`, req.Email, string(hashedPassword), req.Role)
 	
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint") {
@@ -713,19 +1078,35 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	
 	newUserID, _ := result.LastInsertId()
 	
-	// Get ward name for response if applicable
-	var wardName string
-	if req.WardID > 0 {
-		s.db.QueryRow(`SELECT name FROM wards WHERE id = ?`, req.WardID).Scan(&wardName)
+	if err := setUserWards(tx, int(newUserID), wardIDs); err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint") {
+			http.Error(w, "Ward not found", http.StatusBadRequest)
+		} else {
+			log.Printf("Error assigning wards: %v", err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		}
+		return
+	}
+	
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	
+	// Get ward names for response if applicable
+	var wardNames []string
+	for _, wardID := range wardIDs {
+		var name string
+		s.db.QueryRow(`SELECT name FROM wards WHERE id = ?`, wardID).Scan(&name)
+		wardNames = append(wardNames, name)
 	}
 	
 	// Log the activity
 	activityDetail := fmt.Sprintf("Created %s: %s", req.Role, req.Email)
-	if req.WardID > 0 {
-		s.logActivity(req.WardID, &userID, "user_created", activityDetail, 0)
-	} else {
-		s.logActivity(0, &userID, "user_created", activityDetail, 0)
+	if len(wardNames) > 0 {
+		activityDetail += " for " + strings.Join(wardNames, ", ")
 	}
+	s.logActivity(s.logWardForUser(int(newUserID)), &userID, "user_created", activityDetail, 0)
 	
 	// Send success response
 	w.Header().Set("Content-Type", "application/json")
@@ -734,7 +1115,7 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		"user_id": newUserID,
 		"email": req.Email,
 		"role": req.Role,
-		"ward_name": wardName,
+		"ward_name": strings.Join(wardNames, ", "),
 	})
 }
 
@@ -792,6 +1173,17 @@ func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to update password", http.StatusInternalServerError)
 			return
 		}
+
+		// Sign out everywhere else and revoke API tokens in case the old
+		// password was compromised
+		if session := s.getSession(r); session != nil {
+			if _, err := s.revokeUserSessions(userID, session.ID); err != nil {
+				log.Printf("Error revoking other sessions: %v", err)
+			}
+		}
+		if _, err := revokeUserAPITokens(s.db, userID); err != nil {
+			log.Printf("Error revoking API tokens: %v", err)
+		}
 	}
 	
 	// Update email if provided and different
@@ -844,76 +1236,67 @@ func (s *Server) handleGetWards(w http.ResponseWriter, r *http.Request) {
 
 // Helper functions
 
+// getUserIDFromSession returns the signed-in user, or the owner of the API
+// token the request was authenticated with (see withTokenScope), or 0.
 func (s *Server) getUserIDFromSession(r *http.Request) int {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		return 0
+	if userID, ok := r.Context().Value(apiTokenUserKey).(int); ok {
+		return userID
 	}
 
-	userID, err := strconv.Atoi(cookie.Value)
-	if err != nil {
+	session := s.getSession(r)
+	if session == nil || session.TwoFactorPending {
 		return 0
 	}
 
-	return userID
+	return session.UserID
 }
 
-func (s *Server) canApproveForWard(userID, wardID int) bool {
-	var role string
-	var userWardID sql.NullInt64
-
-	err := s.db.QueryRow(`
-		SELECT role, ward_id FROM users WHERE id = ?
-	`, userID).Scan(&role, &userWardID)
-
-	if err != nil {
-		return false
-	}
-
-	// Admins can approve for any ward
-	if role == "admin" {
-		return true
-	}
-
-	// Ward approvers can only approve for their ward
-	if role == "ward_approver" && userWardID.Valid && int(userWardID.Int64) == wardID {
-		return true
-	}
+func (s *Server) isAdmin(userID int) bool {
+	return s.hasPermission(userID, permManageUsers, 0)
+}
 
-	return false
+func (s *Server) canApproveForWard(userID, wardID int) bool {
+	return s.hasPermission(userID, permApproveSubmissions, wardID)
 }
 
+// logActivity records an event in activity_logs. A wardID of 0 records a
+// stake-wide event that isn't tied to any ward.
 func (s *Server) logActivity(wardID int, userID *int, action, details string, points int) {
+	var ward *int
+	if wardID != 0 {
+		ward = &wardID
+	}
+
 	_, err := s.db.Exec(`
 		INSERT INTO activity_logs (ward_id, user_id, action, details, points)
 		VALUES (?, ?, ?, ?, ?)
-	`, wardID, userID, action, details, points)
+	`, ward, userID, action, details, points)
 
 	if err != nil {
 		log.Printf("Error logging activity: %v", err)
 	}
 }
 
+// pointAchievements are earned by reaching a number of verified points.
+var pointAchievements = []struct {
+	threshold int
+	aType     string
+	title     string
+	icon      string
+}{
+	{100, "first_100", "First 100 Points!", "💯"},
+	{500, "first_500", "First to 500!", "⚡"},
+	{1000, "first_1000", "Thousand Club!", "🎯"},
+	{1360, "goal_reached", "Goal Achieved!", "🏆"},
+}
+
 func (s *Server) checkAndAwardAchievements(wardID int) {
 	// Get current ward points
 	var points int
 	s.db.QueryRow("SELECT points FROM wards WHERE id = ?", wardID).Scan(&points)
 
-	// Check various achievement conditions
-	achievements := []struct {
-		condition bool
-		aType     string
-		title     string
-		icon      string
-	}{
-		{points >= 100, "first_100", "First 100 Points!", "💯"},
-		{points >= 500, "first_500", "First to 500!", "⚡"},
-		{points >= 1000, "first_1000", "Thousand Club!", "🎯"},
-		{points >= 1360, "goal_reached", "Goal Achieved!", "🏆"},
-	}
-
-	for _, ach := range achievements {
-		if ach.condition {
+	for _, ach := range pointAchievements {
+		if points >= ach.threshold {
 			_, err := s.db.Exec(`
 				INSERT OR IGNORE INTO achievements (ward_id, type, title, icon)
 				VALUES (?, ?, ?, ?)
@@ -927,8 +1310,36 @@ func (s *Server) checkAndAwardAchievements(wardID int) {
 	}
 }
 
+// revokeLostAchievements removes point achievements a ward no longer has
+// the points for, e.g. after an approval is reversed, and returns their
+// titles.
+func (s *Server) revokeLostAchievements(wardID int) []string {
+	var points int
+	s.db.QueryRow("SELECT points FROM wards WHERE id = ?", wardID).Scan(&points)
+
+	revoked := []string{}
+	for _, ach := range pointAchievements {
+		if points >= ach.threshold {
+			continue
+		}
+
+		result, err := s.db.Exec(`
+			DELETE FROM achievements WHERE ward_id = ? AND type = ?
+		`, wardID, ach.aType)
+		if err != nil {
+			log.Printf("Error revoking achievement: %v", err)
+			continue
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			revoked = append(revoked, ach.title)
+		}
+	}
+
+	return revoked
+}
+
 func (s *Server) broadcastLeaderboardUpdate() {
-	entries, _ := s.getLeaderboardEntries("verified-desc")
+	entries, _ := s.getLeaderboardEntries("verified-desc", "")
 	stats, _ := s.getStats()
 
 	s.broadcastUpdate("leaderboard-update", map[string]interface{}{
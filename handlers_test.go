@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestDecisionsAreMadeOnce(t *testing.T) {
+	tests := []struct {
+		name          string
+		first, second string
+		body          map[string]interface{}
+	}{
+		{"approved twice", "approve", "approve", nil},
+		{"rejected after approval", "approve", "reject", map[string]interface{}{"reason": "Duplicate"}},
+		{"approved after rejection", "reject", "approve", map[string]interface{}{"reason": "Duplicate"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := newTestClient(t, s)
+			admin.login("admin@templepoints.org", "admin123")
+			sub := submitPoints(t, s, 1, 4)
+			points, pending := wardTotals(t, s, 1)
+
+			if rec := admin.do("POST", pointsPath(sub.ID, tt.first), tt.body); rec.Code != http.StatusOK {
+				t.Fatalf("%s: %d %s", tt.first, rec.Code, rec.Body.String())
+			}
+			if rec := admin.do("POST", pointsPath(sub.ID, tt.second), tt.body); rec.Code != http.StatusConflict {
+				t.Errorf("%s after %s: status %d, want %d", tt.second, tt.first, rec.Code, http.StatusConflict)
+			}
+
+			wantPoints := points
+			if tt.first == "approve" {
+				wantPoints += sub.Points
+			}
+			if gotPoints, gotPending := wardTotals(t, s, 1); gotPoints != wantPoints || gotPending != pending-sub.Points {
+				t.Errorf("ward totals = %d, %d; want %d, %d", gotPoints, gotPending, wantPoints, pending-sub.Points)
+			}
+		})
+	}
+}
+
+func TestConcurrentApprovals(t *testing.T) {
+	s := newTestServer(t)
+	sub := submitPoints(t, s, 1, 4)
+	points, _ := wardTotals(t, s, 1)
+
+	const approvers = 8
+	codes := make(chan int, approvers)
+	var wg sync.WaitGroup
+	for i := 0; i < approvers; i++ {
+		admin := newTestClient(t, s)
+		admin.login("admin@templepoints.org", "admin123")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- admin.do("POST", pointsPath(sub.ID, "approve"), nil).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	approved := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			approved++
+		}
+	}
+	if approved != 1 {
+		t.Errorf("%d approvals succeeded, want 1", approved)
+	}
+
+	var entries int
+	s.db.QueryRow(`SELECT COUNT(*) FROM points_ledger WHERE submission_id = ? AND entry_type = 'approved'`,
+		sub.ID).Scan(&entries)
+	if entries != 1 {
+		t.Errorf("%d approved ledger entries, want 1", entries)
+	}
+	if got, _ := wardTotals(t, s, 1); got != points+sub.Points {
+		t.Errorf("ward points = %d, want %d", got, points+sub.Points)
+	}
+}
+
+func TestApproveAwardLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		awarded int
+		note    string
+		want    int
+	}{
+		{"nothing", 0, "None of these count", http.StatusBadRequest},
+		{"negative", -1, "None of these count", http.StatusBadRequest},
+		{"one", 1, "Only one counts", http.StatusOK},
+		{"less without a note", 4, "", http.StatusBadRequest},
+		{"the claim", 5, "", http.StatusOK},
+		{"more than the claim", 6, "They did an extra one", http.StatusBadRequest},
+		{"far more than the claim", 1 << 40, "Overflow", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := newTestClient(t, s)
+			admin.login("admin@templepoints.org", "admin123")
+			sub := submitUnitemized(t, s, 1, 5)
+			points, _ := wardTotals(t, s, 1)
+
+			rec := admin.do("POST", pointsPath(sub.ID, "approve"), map[string]interface{}{"points": tt.awarded, "note": tt.note})
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+
+			want := points
+			if tt.want == http.StatusOK {
+				want += tt.awarded
+			}
+			if got, _ := wardTotals(t, s, 1); got != want {
+				t.Errorf("ward points = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDecideSubmissionConflicts(t *testing.T) {
+	approve := decision{Status: "approved", Points: 5}
+	amend := func(points int, note string, items []SubmissionItem) func(*testing.T, *Server, *PointSubmission) {
+		return func(t *testing.T, s *Server, sub *PointSubmission) {
+			tx, err := s.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			r := httptest.NewRequest("POST", "/api/receipts/code", nil)
+			if err := recordSubmissionEdit(tx, r, sub, ledgerAmended, points, note, items); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(*testing.T, *Server, *PointSubmission)
+		want   error
+	}{
+		{"unchanged", nil, nil},
+		{"points amended", amend(8, "", nil), errSubmissionAmended},
+		{"note amended", amend(5, "A different trip", nil), errSubmissionAmended},
+		{"items amended", amend(5, "", []SubmissionItem{
+			{Category: "initiatory", Quantity: 5, PointsEach: 1, BasePoints: 5, Points: 5}}), errSubmissionAmended},
+		{"decided by another approver", func(t *testing.T, s *Server, sub *PointSubmission) {
+			if _, err := s.db.Exec(`UPDATE point_submissions SET status = 'rejected' WHERE id = ?`, sub.ID); err != nil {
+				t.Fatal(err)
+			}
+		}, errSubmissionNotPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			sub, err := querySubmission(s.db, submitPoints(t, s, 1, 5).ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(t, s, sub)
+			}
+
+			tx, err := s.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			if err := decideSubmission(tx, sub, 1, approve); err != tt.want {
+				t.Fatalf("decideSubmission = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			current, err := querySubmission(s.db, sub.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current.Status != "approved" {
+				t.Errorf("status = %s, want approved", current.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// issueInvitationToken gives the invitation a fresh token and expiry and
+// emails the signed link. Any earlier link for it stops working.
+func (s *Server) issueInvitationToken(invitationID int, email, role string) error {
+	base, err := s.emailLinkBaseURL()
+	if err != nil {
+		return err
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE invitations
+		SET token_hash = ?, last_sent_at = CURRENT_TIMESTAMP, expires_at = datetime('now', ?)
+		WHERE id = ?
+	`, hashToken(token), fmt.Sprintf("+%d seconds", int(invitationTTL.Seconds())), invitationID)
+	if err != nil {
+		return err
+	}
+
+	link := base + "/accept-invite?token=" + url.QueryEscape(s.signValue(token))
+	s.sendMail(email, "You're invited to Temple Points", fmt.Sprintf(
+		"You've been invited to help run the Temple Points challenge with the %s role.\n\n"+
+			"Open this link within %d days to choose your password and sign in:\n\n%s\n",
+		roleDefinitions[role].Label, int(invitationTTL.Hours()/24), link))
+
+	return nil
+}
+
+// lookupInvitation resolves a signed link token to a pending, unexpired
+// invitation.
+func (s *Server) lookupInvitation(q rowQuerier, signedToken string) (*Invitation, error) {
+	token, ok := s.verifySignedValue(signedToken)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	var inv Invitation
+	err := q.QueryRow(`
+		SELECT id, email, role, expires_at
+		FROM invitations
+		WHERE token_hash = ? AND accepted_at IS NULL AND revoked_at IS NULL
+		AND expires_at > CURRENT_TIMESTAMP
+	`, hashToken(token)).Scan(&inv.ID, &inv.Email, &inv.Role, &inv.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.Wards, err = invitationWards(q, inv.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// invitationWards lists the wards an invitation covers, in ID order.
+func invitationWards(q rowQuerier, invitationID int) ([]WardRef, error) {
+	rows, err := q.Query(`
+		SELECT w.id, w.name
+		FROM invitation_wards iw
+		JOIN wards w ON iw.ward_id = w.id
+		WHERE iw.invitation_id = ?
+		ORDER BY w.id
+	`, invitationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	wards := []WardRef{}
+	for rows.Next() {
+		var ward WardRef
+		if err := rows.Scan(&ward.ID, &ward.Name); err != nil {
+			return nil, err
+		}
+		wards = append(wards, ward)
+	}
+	return wards, rows.Err()
+}
+
+// invitationLogWard is logWard for the wards an invitation covers.
+func invitationLogWard(q rowQuerier, invitationID int) int {
+	wards, err := invitationWards(q, invitationID)
+	if err != nil {
+		return 0
+	}
+	return logWard(wardRefIDs(wards))
+}
+
+// Invite someone to become an admin or ward approver (admin only)
+func (s *Server) handleCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	if _, err := s.emailLinkBaseURL(); err != nil {
+		http.Error(w, "Invitations can't be emailed until BASE_URL is configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	// ward_id is still accepted from older clients
+	var req struct {
+		Email   string `json:"email"`
+		Role    string `json:"role"`
+		WardIDs []int  `json:"ward_ids"`
+		WardID  int    `json:"ward_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || req.Role == "" {
+		http.Error(w, "Email and role are required", http.StatusBadRequest)
+		return
+	}
+
+	requested := req.WardIDs
+	if req.WardID > 0 {
+		requested = append(requested, req.WardID)
+	}
+	wardIDs, msg := validateRoleAssignment(req.Role, requested)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, req.Email).Scan(&exists)
+	if exists {
+		http.Error(w, "Email already exists", http.StatusConflict)
+		return
+	}
+
+	// The real token is set by issueInvitationToken; this placeholder only
+	// satisfies the UNIQUE constraint
+	placeholder, err := generateToken(32)
+	if err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A new invitation replaces any that are still outstanding for this email
+	_, err = tx.Exec(`
+		UPDATE invitations SET revoked_at = CURRENT_TIMESTAMP
+		WHERE email = ? AND accepted_at IS NULL AND revoked_at IS NULL
+	`, req.Email)
+	if err != nil {
+		log.Printf("Error revoking old invitations: %v", err)
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO invitations (email, role, token_hash, invited_by, expires_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, req.Email, req.Role, hashToken(placeholder), userID)
+	if err == nil {
+		id, _ := result.LastInsertId()
+		for _, wardID := range wardIDs {
+			_, err = tx.Exec(`INSERT INTO invitation_wards (invitation_id, ward_id) VALUES (?, ?)`, id, wardID)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint") {
+			http.Error(w, "Ward not found", http.StatusBadRequest)
+		} else {
+			log.Printf("Error creating invitation: %v", err)
+			http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	invitationID, _ := result.LastInsertId()
+	if err := s.issueInvitationToken(int(invitationID), req.Email, req.Role); err != nil {
+		log.Printf("Error sending invitation: %v", err)
+		http.Error(w, "Failed to send invitation", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(logWard(wardIDs), &userID, "user_invited",
+		fmt.Sprintf("Invited %s as %s", req.Email, req.Role), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"invitation_id": invitationID,
+		"message":       fmt.Sprintf("Invitation sent to %s", req.Email),
+	})
+}
+
+// List invitations that haven't been accepted or revoked (admin only)
+func (s *Server) handleListInvitations(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT i.id, i.email, i.role, COALESCE(u.email, ''),
+		       i.created_at, i.last_sent_at, i.expires_at, i.expires_at <= CURRENT_TIMESTAMP
+		FROM invitations i
+		LEFT JOIN users u ON i.invited_by = u.id
+		WHERE i.accepted_at IS NULL AND i.revoked_at IS NULL
+		ORDER BY i.created_at DESC
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error querying invitations: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy,
+			&inv.CreatedAt, &inv.LastSentAt, &inv.ExpiresAt, &inv.Expired)
+		if err != nil {
+			log.Printf("Error scanning invitation: %v", err)
+			continue
+		}
+		invitations = append(invitations, inv)
+	}
+	rows.Close()
+
+	for i := range invitations {
+		invitations[i].Wards, err = invitationWards(s.db, invitations[i].ID)
+		if err != nil {
+			log.Printf("Error loading invitation wards: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// Send a pending invitation again with a fresh link (admin only)
+func (s *Server) handleResendInvitation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	if _, err := s.emailLinkBaseURL(); err != nil {
+		http.Error(w, "Invitations can't be emailed until BASE_URL is configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	invitationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	var email, role string
+	err = s.db.QueryRow(`
+		SELECT email, role FROM invitations
+		WHERE id = ? AND accepted_at IS NULL AND revoked_at IS NULL
+	`, invitationID).Scan(&email, &role)
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.issueInvitationToken(invitationID, email, role); err != nil {
+		log.Printf("Error resending invitation: %v", err)
+		http.Error(w, "Failed to send invitation", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(invitationLogWard(s.db, invitationID), &userID, "invitation_resent",
+		fmt.Sprintf("Resent invitation to %s", email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Invitation resent to %s", email),
+	})
+}
+
+// Cancel a pending invitation (admin only)
+func (s *Server) handleRevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	invitationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	err = s.db.QueryRow(`
+		SELECT email FROM invitations
+		WHERE id = ? AND accepted_at IS NULL AND revoked_at IS NULL
+	`, invitationID).Scan(&email)
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE invitations SET revoked_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, invitationID)
+	if err != nil {
+		http.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(invitationLogWard(s.db, invitationID), &userID, "invitation_revoked",
+		fmt.Sprintf("Revoked invitation for %s", email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Invitation revoked",
+	})
+}
+
+// Look up an invitation from its link so the accept page can show it
+func (s *Server) handleGetInvitation(w http.ResponseWriter, r *http.Request) {
+	inv, err := s.lookupInvitation(s.db, r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "This invitation is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email":      inv.Email,
+		"role":       inv.Role,
+		"wards":      inv.Wards,
+		"expires_at": inv.ExpiresAt,
+	})
+}
+
+// Accept an invitation by choosing a password; signs the new user in
+func (s *Server) handleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength),
+			http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error processing password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	inv, err := s.lookupInvitation(tx, req.Token)
+	if err != nil {
+		http.Error(w, "This invitation is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	result, err := tx.Exec(`
+		UPDATE invitations SET accepted_at = CURRENT_TIMESTAMP WHERE id = ? AND accepted_at IS NULL
+	`, inv.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		http.Error(w, "This invitation is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	result, err = tx.Exec(`
+		INSERT INTO users (email, password, role) VALUES (?, ?, ?)
+	`, inv.Email, string(hashedPassword), inv.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint") {
+			http.Error(w, "An account already exists for this email", http.StatusConflict)
+		} else {
+			log.Printf("Error creating invited user: %v", err)
+			http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	newUserID, _ := result.LastInsertId()
+
+	user := User{
+		ID:    int(newUserID),
+		Email: inv.Email,
+		Role:  inv.Role,
+		Wards: inv.Wards,
+	}
+
+	if err := setUserWards(tx, user.ID, wardRefIDs(inv.Wards)); err != nil {
+		log.Printf("Error assigning invited user's wards: %v", err)
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(logWard(wardRefIDs(user.Wards)), &user.ID, "invitation_accepted",
+		fmt.Sprintf("%s accepted their invitation as %s", inv.Email, inv.Role), 0)
+
+	s.finishLogin(w, r, user)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// invite has admin invite someone and returns the token from the emailed
+// link.
+func invite(t *testing.T, admin *testClient, received <-chan fakeMail, body map[string]interface{}) string {
+	t.Helper()
+
+	rec := admin.do("POST", "/api/invitations", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("inviting: %d %s", rec.Code, rec.Body.String())
+	}
+
+	link, err := url.Parse(readMailLine(t, waitForMail(t, received), "/accept-invite?token="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestInvitationAcceptance(t *testing.T) {
+	s, received := newMailingServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+
+	token := invite(t, admin, received, map[string]interface{}{
+		"email": "approver@example.org", "role": "ward_approver", "ward_ids": []int{2},
+	})
+
+	var info struct {
+		Email string    `json:"email"`
+		Role  string    `json:"role"`
+		Wards []WardRef `json:"wards"`
+	}
+	decodeJSON(t, newTestClient(t, s).do("GET", "/api/invitations/accept?token="+url.QueryEscape(token), nil), &info)
+	if info.Email != "approver@example.org" || info.Role != "ward_approver" || len(info.Wards) != 1 || info.Wards[0].ID != 2 {
+		t.Errorf("invitation = %+v", info)
+	}
+
+	invitee := newTestClient(t, s)
+	accept := map[string]string{"token": token, "password": testPassword}
+	if rec := invitee.do("POST", "/api/invitations/accept", accept); rec.Code != http.StatusOK {
+		t.Fatalf("accepting: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var user User
+	decodeJSON(t, invitee.do("GET", "/api/user", nil), &user)
+	if user.Email != "approver@example.org" || user.Role != "ward_approver" || len(user.Wards) != 1 || user.Wards[0].ID != 2 {
+		t.Errorf("new user = %+v", user)
+	}
+
+	if rec := newTestClient(t, s).do("POST", "/api/invitations/accept", accept); rec.Code != http.StatusNotFound {
+		t.Errorf("accepting twice: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestInvitationLinksThatDontWork(t *testing.T) {
+	s, received := newMailingServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	body := map[string]interface{}{"email": "clerk@example.org", "role": "clerk", "ward_ids": []int{1}}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+	}{
+		{"revoked", func(t *testing.T) string {
+			token := invite(t, admin, received, body)
+			var id int
+			s.db.QueryRow(`SELECT id FROM invitations WHERE revoked_at IS NULL AND accepted_at IS NULL`).Scan(&id)
+			if rec := admin.do("DELETE", "/api/invitations/"+strconv.Itoa(id), nil); rec.Code != http.StatusOK {
+				t.Fatalf("revoking: %d %s", rec.Code, rec.Body.String())
+			}
+			return token
+		}},
+		{"expired", func(t *testing.T) string {
+			token := invite(t, admin, received, body)
+			s.db.Exec(`UPDATE invitations SET expires_at = datetime('now', '-1 minute')`)
+			return token
+		}},
+		{"replaced by a newer invitation", func(t *testing.T) string {
+			token := invite(t, admin, received, body)
+			invite(t, admin, received, body)
+			return token
+		}},
+		{"unsigned", func(t *testing.T) string {
+			token := invite(t, admin, received, body)
+			raw, _ := s.verifySignedValue(token)
+			return raw
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token(t)
+			rec := newTestClient(t, s).do("POST", "/api/invitations/accept",
+				map[string]string{"token": token, "password": testPassword})
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status %d, want %d", rec.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestCreateInvitationChecks(t *testing.T) {
+	s, _ := newMailingServer(t)
+	createTestUser(t, s, "approver@example.org", "ward_approver", 1)
+
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	approver := newTestClient(t, s)
+	approver.login("approver@example.org", testPassword)
+
+	tests := []struct {
+		name   string
+		client *testClient
+		body   map[string]interface{}
+		want   int
+	}{
+		{"not an admin", approver, map[string]interface{}{"email": "x@example.org", "role": "clerk", "ward_ids": []int{1}},
+			http.StatusForbidden},
+		{"existing user", admin, map[string]interface{}{"email": "approver@example.org", "role": "clerk",
+			"ward_ids": []int{1}}, http.StatusConflict},
+		{"unknown role", admin, map[string]interface{}{"email": "x@example.org", "role": "bishop"},
+			http.StatusBadRequest},
+		{"missing email", admin, map[string]interface{}{"role": "admin"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := tt.client.do("POST", "/api/invitations", tt.body); rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	s.config.BaseURL = ""
+	rec := admin.do("POST", "/api/invitations", map[string]interface{}{"email": "x@example.org", "role": "admin"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("without BASE_URL: status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Every change to a ward's points is recorded in points_ledger, which is
+// never updated or deleted. wards.points and wards.pending_points are a
+// cache of the ledger's sums: they're updated in the same transaction as
+// each entry, and rebuildWardTotals recomputes them from scratch.
+const (
+	ledgerSubmitted  = "submitted"
+	ledgerAmended    = "amended"
+	ledgerWithdrawn  = "withdrawn"
+	ledgerApproved   = "approved"
+	ledgerRejected   = "rejected"
+	ledgerReversed   = "reversed"
+	ledgerAdjustment = "adjustment"
+)
+
+// recordLedgerEntry appends an entry inside tx and applies it to the ward's
+// cached totals.
+func recordLedgerEntry(tx *sql.Tx, entry LedgerEntry) error {
+	_, err := tx.Exec(`
+		INSERT INTO points_ledger (ward_id, submission_id, entry_type, verified_delta, pending_delta, user_id, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, entry.WardID, entry.SubmissionID, entry.EntryType, entry.VerifiedDelta, entry.PendingDelta,
+		entry.UserID, entry.Note)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE wards
+		SET points = points + ?,
+		    pending_points = pending_points + ?
+		WHERE id = ?
+	`, entry.VerifiedDelta, entry.PendingDelta, entry.WardID)
+	return err
+}
+
+// WardTotalsChange describes a ward whose cached totals didn't match the
+// ledger.
+type WardTotalsChange struct {
+	WardID        int    `json:"ward_id"`
+	WardName      string `json:"ward_name"`
+	CachedPoints  int    `json:"cached_points"`
+	LedgerPoints  int    `json:"ledger_points"`
+	CachedPending int    `json:"cached_pending_points"`
+	LedgerPending int    `json:"ledger_pending_points"`
+}
+
+// wardTotalsDrift compares every ward's cached totals with the ledger.
+func wardTotalsDrift(q rowQuerier) ([]WardTotalsChange, error) {
+	rows, err := q.Query(`
+		SELECT w.id, w.name, COALESCE(w.points, 0), COALESCE(w.pending_points, 0),
+		       COALESCE(SUM(l.verified_delta), 0), COALESCE(SUM(l.pending_delta), 0)
+		FROM wards w
+		LEFT JOIN points_ledger l ON l.ward_id = w.id
+		GROUP BY w.id
+		ORDER BY w.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []WardTotalsChange{}
+	for rows.Next() {
+		var c WardTotalsChange
+		err := rows.Scan(&c.WardID, &c.WardName, &c.CachedPoints, &c.CachedPending,
+			&c.LedgerPoints, &c.LedgerPending)
+		if err != nil {
+			return nil, err
+		}
+		if c.CachedPoints != c.LedgerPoints || c.CachedPending != c.LedgerPending {
+			changes = append(changes, c)
+		}
+	}
+	return changes, rows.Err()
+}
+
+// rebuildWardTotals recomputes every ward's cached totals from the ledger and
+// returns the wards that were wrong.
+func rebuildWardTotals(db *sql.DB) ([]WardTotalsChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changes, err := wardTotalsDrift(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recomputeWardTotals(tx); err != nil {
+		return nil, err
+	}
+
+	return changes, tx.Commit()
+}
+
+// recomputeWardTotals sets every ward's cached totals to its ledger sums.
+func recomputeWardTotals(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		UPDATE wards
+		SET points = (
+			SELECT COALESCE(SUM(verified_delta), 0) FROM points_ledger WHERE ward_id = wards.id
+		),
+		pending_points = (
+			SELECT COALESCE(SUM(pending_delta), 0) FROM points_ledger WHERE ward_id = wards.id
+		)
+	`)
+	return err
+}
+
+// backfillLedger creates the ledger for a database that predates it: an
+// entry for each submission and decision, then an opening balance for any
+// ward whose stored totals don't match its submissions, so no ward's score
+// changes. It does nothing once the ledger has entries.
+func backfillLedger(db *sql.DB) error {
+	var entries int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM points_ledger`).Scan(&entries); err != nil {
+		return err
+	}
+	if entries > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`INSERT INTO points_ledger (ward_id, submission_id, entry_type, pending_delta, user_id, created_at)
+		 SELECT ward_id, id, 'submitted', points, submitted_by, created_at
+		 FROM point_submissions`,
+		`INSERT INTO points_ledger (ward_id, submission_id, entry_type, verified_delta, pending_delta, user_id, created_at)
+		 SELECT ward_id, id, status, CASE WHEN status = 'approved' THEN COALESCE(awarded_points, points) ELSE 0 END, -points,
+		        approved_by, COALESCE(approved_at, created_at)
+		 FROM point_submissions
+		 WHERE status IN ('approved', 'rejected')`,
+		`INSERT INTO points_ledger (ward_id, entry_type, verified_delta, pending_delta, note)
+		 SELECT w.id, 'adjustment',
+		        COALESCE(w.points, 0) - COALESCE(SUM(l.verified_delta), 0),
+		        COALESCE(w.pending_points, 0) - COALESCE(SUM(l.pending_delta), 0),
+		        'Opening balance carried over from before the ledger'
+		 FROM wards w
+		 LEFT JOIN points_ledger l ON l.ward_id = w.id
+		 GROUP BY w.id
+		 HAVING COALESCE(w.points, 0) != COALESCE(SUM(l.verified_delta), 0)
+		     OR COALESCE(w.pending_points, 0) != COALESCE(SUM(l.pending_delta), 0)`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get a ward's ledger with running totals, oldest first. Like the ward log,
+// this is public so anyone can check how a score was reached.
+func (s *Server) handleGetWardLedger(w http.ResponseWriter, r *http.Request) {
+	wardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ward ID", http.StatusBadRequest)
+		return
+	}
+
+	var wardName string
+	var points, pendingPoints int
+	err = s.db.QueryRow(`
+		SELECT name, points, pending_points FROM wards WHERE id = ?
+	`, wardID).Scan(&wardName, &points, &pendingPoints)
+	if err != nil {
+		http.Error(w, "Ward not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT l.id, l.ward_id, l.submission_id, COALESCE(p.submitter_name, ''), l.entry_type,
+		       l.verified_delta, l.pending_delta, COALESCE(l.note, ''), l.created_at
+		FROM points_ledger l
+		LEFT JOIN point_submissions p ON l.submission_id = p.id
+		WHERE l.ward_id = ?
+		ORDER BY l.id
+	`, wardID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error querying ledger: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	var verified, pending int
+	for rows.Next() {
+		var e LedgerEntry
+		err := rows.Scan(&e.ID, &e.WardID, &e.SubmissionID, &e.SubmitterName, &e.EntryType,
+			&e.VerifiedDelta, &e.PendingDelta, &e.Note, &e.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning ledger entry: %v", err)
+			continue
+		}
+		verified += e.VerifiedDelta
+		pending += e.PendingDelta
+		e.VerifiedBalance = verified
+		e.PendingBalance = pending
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ward_id":               wardID,
+		"ward_name":             wardName,
+		"points":                verified,
+		"pending_points":        pending,
+		"cached_points":         points,
+		"cached_pending_points": pendingPoints,
+		"entries":               entries,
+	})
+}
+
+// Add or remove verified points by hand, e.g. to settle a dispute (admin
+// only). The reason is kept in the ledger.
+func (s *Server) handleAdjustWardPoints(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	wardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ward ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Points int    `json:"points"`
+		Reason string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Points == 0 || req.Reason == "" {
+		http.Error(w, "Points and a reason are required", http.StatusBadRequest)
+		return
+	}
+
+	var wardName string
+	if err := s.db.QueryRow(`SELECT name FROM wards WHERE id = ?`, wardID).Scan(&wardName); err != nil {
+		http.Error(w, "Ward not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = recordLedgerEntry(tx, LedgerEntry{
+		WardID:        wardID,
+		EntryType:     ledgerAdjustment,
+		VerifiedDelta: req.Points,
+		UserID:        &userID,
+		Note:          req.Reason,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error adjusting ward points: %v", err)
+		http.Error(w, "Failed to adjust points", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Points > 0 {
+		s.checkAndAwardAchievements(wardID)
+	}
+
+	s.logActivity(wardID, &userID, "points_adjusted",
+		fmt.Sprintf("Adjusted %s by %+d points: %s", wardName, req.Points, req.Reason), req.Points)
+
+	s.broadcastLeaderboardUpdate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Adjusted %s by %+d points", wardName, req.Points),
+	})
+}
+
+// Recompute every ward's totals from the ledger (admin only)
+func (s *Server) handleRebuildWardTotals(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	changes, err := rebuildWardTotals(s.db)
+	if err != nil {
+		log.Printf("Error rebuilding ward totals: %v", err)
+		http.Error(w, "Failed to rebuild totals", http.StatusInternalServerError)
+		return
+	}
+
+	if len(changes) > 0 {
+		s.logActivity(0, &userID, "totals_rebuilt",
+			fmt.Sprintf("Rebuilt ward totals from the ledger; corrected %d ward(s)", len(changes)), 0)
+		s.broadcastLeaderboardUpdate()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"corrected": changes,
+	})
+}
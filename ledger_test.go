@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLedgerFollowsSubmissions(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	points, pending := wardTotals(t, s, 1)
+
+	steps := []struct {
+		name                        string
+		do                          func(t *testing.T)
+		verifiedDelta, pendingDelta int
+	}{
+		{"submitted", func(t *testing.T) { submitPoints(t, s, 1, 3) }, 0, 3},
+		{"approved", func(t *testing.T) {
+			sub := submitPoints(t, s, 1, 5)
+			if rec := admin.do("POST", pointsPath(sub.ID, "approve"), nil); rec.Code != http.StatusOK {
+				t.Fatalf("approving: %d %s", rec.Code, rec.Body.String())
+			}
+		}, 5, 0},
+		{"rejected", func(t *testing.T) {
+			sub := submitPoints(t, s, 1, 2)
+			rec := admin.do("POST", pointsPath(sub.ID, "reject"), map[string]string{"reason": "Duplicate"})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("rejecting: %d %s", rec.Code, rec.Body.String())
+			}
+		}, 0, 0},
+		{"adjusted", func(t *testing.T) {
+			rec := admin.do("POST", "/api/ward/1/adjustments", map[string]interface{}{"points": -4, "reason": "Counted twice"})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("adjusting: %d %s", rec.Code, rec.Body.String())
+			}
+		}, -4, 0},
+	}
+
+	for _, step := range steps {
+		step.do(t)
+		points += step.verifiedDelta
+		pending += step.pendingDelta
+		if gotPoints, gotPending := wardTotals(t, s, 1); gotPoints != points || gotPending != pending {
+			t.Errorf("after %s: ward totals = %d, %d; want %d, %d", step.name, gotPoints, gotPending, points, pending)
+		}
+	}
+
+	var ledger struct {
+		Points        int           `json:"points"`
+		PendingPoints int           `json:"pending_points"`
+		Entries       []LedgerEntry `json:"entries"`
+	}
+	decodeJSON(t, newTestClient(t, s).do("GET", "/api/ward/1/ledger", nil), &ledger)
+	if ledger.Points != points || ledger.PendingPoints != pending {
+		t.Errorf("ledger sums = %d, %d; want %d, %d", ledger.Points, ledger.PendingPoints, points, pending)
+	}
+	last := ledger.Entries[len(ledger.Entries)-1]
+	if last.EntryType != ledgerAdjustment || last.VerifiedDelta != -4 || last.VerifiedBalance != points {
+		t.Errorf("last entry = %+v", last)
+	}
+
+	if drift, err := wardTotalsDrift(s.db); err != nil || len(drift) != 0 {
+		t.Errorf("drift = %+v, %v", drift, err)
+	}
+}
+
+func TestAdjustmentsNeedAdminAndReason(t *testing.T) {
+	s := newTestServer(t)
+	createTestUser(t, s, "approver@example.org", "ward_approver", 1)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	approver := newTestClient(t, s)
+	approver.login("approver@example.org", testPassword)
+
+	tests := []struct {
+		name   string
+		client *testClient
+		body   map[string]interface{}
+		want   int
+	}{
+		{"approver", approver, map[string]interface{}{"points": 5, "reason": "Bonus"}, http.StatusForbidden},
+		{"no reason", admin, map[string]interface{}{"points": 5}, http.StatusBadRequest},
+		{"no points", admin, map[string]interface{}{"reason": "Bonus"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := tt.client.do("POST", "/api/ward/1/adjustments", tt.body); rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebuildWardTotals(t *testing.T) {
+	s := newTestServer(t)
+	points, pending := wardTotals(t, s, 3)
+
+	if _, err := s.db.Exec(`UPDATE wards SET points = points + 100, pending_points = 0 WHERE id = 3`); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := rebuildWardTotals(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].WardID != 3 || changes[0].CachedPoints != points+100 ||
+		changes[0].LedgerPoints != points {
+		t.Errorf("changes = %+v", changes)
+	}
+	if gotPoints, gotPending := wardTotals(t, s, 3); gotPoints != points || gotPending != pending {
+		t.Errorf("rebuilt totals = %d, %d; want %d, %d", gotPoints, gotPending, points, pending)
+	}
+
+	if changes, _ := rebuildWardTotals(s.db); len(changes) != 0 {
+		t.Errorf("second rebuild changed %+v", changes)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	magicLinkTTL = 15 * time.Minute
+
+	// At most this many sign-in links per account per hour
+	magicLinkHourlyLimit = 5
+)
+
+func magicLinkSettingKey(role string) string {
+	return "magic_link:" + role
+}
+
+// magicLinkAllowed reports whether an admin has turned on emailed sign-in
+// links for role. They're off for every role until enabled.
+func (s *Server) magicLinkAllowed(role string) bool {
+	value, err := getSetting(s.db, magicLinkSettingKey(role))
+	return err == nil && value == "true"
+}
+
+// Email a single-use sign-in link. Like password resets, the response doesn't
+// reveal whether the email has an account or whether its role may use links.
+func (s *Server) handleRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.sendMagicLink(r, strings.TrimSpace(req.Email)); err != nil {
+		log.Printf("Error requesting sign-in link: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "If that email can sign in with a link, one is on its way.",
+	})
+}
+
+func (s *Server) sendMagicLink(r *http.Request, email string) error {
+	base, err := s.emailLinkBaseURL()
+	if err != nil {
+		return err
+	}
+
+	var userID int
+	var role string
+	err = s.db.QueryRow(`
+		SELECT id, role FROM users WHERE email = ? AND disabled = 0
+	`, email).Scan(&userID, &role)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !s.magicLinkAllowed(role) {
+		return nil
+	}
+
+	var recent int
+	err = s.db.QueryRow(`
+		SELECT COUNT(*) FROM magic_links
+		WHERE user_id = ? AND created_at > datetime('now', '-1 hour')
+	`, userID).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent >= magicLinkHourlyLimit {
+		log.Printf("Sign-in link limit reached for user %d", userID)
+		return nil
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the newest link works
+	_, err = s.db.Exec(`
+		UPDATE magic_links SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO magic_links (user_id, token_hash, ip_address, expires_at)
+		VALUES (?, ?, ?, datetime('now', ?))
+	`, userID, hashToken(token), clientIP(r),
+		fmt.Sprintf("+%d seconds", int(magicLinkTTL.Seconds())))
+	if err != nil {
+		return err
+	}
+
+	// The link opens the login page, which signs in with a POST, so mail
+	// scanners that fetch links don't use it up
+	link := base + "/login?magic=" + url.QueryEscape(s.signValue(token))
+	s.sendMail(email, "Your Temple Points sign-in link", fmt.Sprintf(
+		"Someone asked to sign in to your Temple Points account.\n\n"+
+			"To sign in, open this link within %d minutes. It can only be used once:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n",
+		int(magicLinkTTL.Minutes()), link))
+
+	s.logActivity(s.logWardForUser(userID), &userID, "magic_link_requested",
+		fmt.Sprintf("Sign-in link requested for %s from %s", email, clientIP(r)), 0)
+
+	return nil
+}
+
+// Sign in with an emailed link
+func (s *Server) handleMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token, ok := s.verifySignedValue(req.Token)
+	if !ok {
+		http.Error(w, "This sign-in link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var linkID int
+	var user User
+	err = tx.QueryRow(`
+		SELECT m.id, u.id, u.email, u.role, u.totp_enabled, u.disabled
+		FROM magic_links m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.token_hash = ? AND m.used_at IS NULL AND m.expires_at > CURRENT_TIMESTAMP
+	`, hashToken(token)).Scan(&linkID, &user.ID, &user.Email, &user.Role,
+		&user.TwoFactorEnabled, &user.Disabled)
+	if err != nil {
+		http.Error(w, "This sign-in link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	// Claim the link; if another request got there first, stop
+	result, err := tx.Exec(`
+		UPDATE magic_links SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL
+	`, linkID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		http.Error(w, "This sign-in link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// The role may have changed, or links been turned off, since it was sent
+	if !s.magicLinkAllowed(user.Role) {
+		http.Error(w, "Sign-in links aren't available for your account. Please use your password.",
+			http.StatusForbidden)
+		return
+	}
+
+	// The owner has proven control of the mailbox, so lift any lockout
+	if err := s.clearLoginFailures(emailThrottleKey(user.Email)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	s.logActivity(s.logWardForUser(user.ID), &user.ID, "magic_link_login",
+		fmt.Sprintf("%s signed in with an emailed link from %s", user.Email, clientIP(r)), 0)
+
+	s.finishLogin(w, r, user)
+}
+
+// View or change which roles may sign in with emailed links (admin only)
+func (s *Server) handleMagicLinkPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			EnabledRoles []string `json:"enabled_roles"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		enabled := map[string]bool{}
+		for _, role := range req.EnabledRoles {
+			if !isValidRole(role) {
+				http.Error(w, fmt.Sprintf("Invalid role %q", role), http.StatusBadRequest)
+				return
+			}
+			enabled[role] = true
+		}
+
+		for _, role := range userRoles {
+			if err := setSetting(s.db, magicLinkSettingKey(role), strconv.FormatBool(enabled[role])); err != nil {
+				log.Printf("Error saving sign-in link policy: %v", err)
+				http.Error(w, "Failed to save policy", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		s.logActivity(0, &userID, "magic_link_policy_changed",
+			fmt.Sprintf("Sign-in links enabled for: %s", strings.Join(req.EnabledRoles, ", ")), 0)
+	}
+
+	enabledRoles := []string{}
+	for _, role := range userRoles {
+		if s.magicLinkAllowed(role) {
+			enabledRoles = append(enabledRoles, role)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled_roles": enabledRoles,
+	})
+}
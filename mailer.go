@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends outbound email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer delivers mail through an SMTP server. Pointing it at a local
+// stand-in such as MailHog (SMTP_HOST=localhost SMTP_PORT=1025) is enough
+// for testing.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, m.Port)
+	return smtp.SendMail(addr, auth, from.Address, []string{to}, []byte(msg.String()))
+}
+
+// logMailer is used when no SMTP server is configured. It writes messages
+// to the log so links can be picked up during development.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s (SMTP not configured)\nSubject: %s\n\n%s", to, subject, body)
+	return nil
+}
+
+func newMailer(config *Config) Mailer {
+	if config.SMTPHost == "" {
+		return logMailer{}
+	}
+
+	return &SMTPMailer{
+		Host:     config.SMTPHost,
+		Port:     config.SMTPPort,
+		Username: config.SMTPUsername,
+		Password: config.SMTPPassword,
+		From:     config.SMTPFrom,
+	}
+}
+
+// sendMail delivers a message in the background so request handlers don't
+// wait on (or reveal timing from) the mail server.
+func (s *Server) sendMail(to, subject, body string) {
+	go func() {
+		if err := s.mailer.Send(to, subject, body); err != nil {
+			log.Printf("Error sending email to %s: %v", to, err)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMail is a message accepted by the fake SMTP server.
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// newFakeSMTP starts a minimal SMTP server on a local port and returns a
+// mailer pointed at it along with the messages it receives.
+func newFakeSMTP(t *testing.T) (*SMTPMailer, <-chan fakeMail) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan fakeMail, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, received)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return &SMTPMailer{Host: host, Port: port, From: "Temple Points <noreply@example.org>"}, received
+}
+
+func serveFakeSMTP(conn net.Conn, received chan<- fakeMail) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+
+	var msg fakeMail
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 fake")
+		case "MAIL":
+			msg = fakeMail{From: line[strings.Index(line, ":")+1:]}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, line[strings.Index(line, ":")+1:])
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			msg.Data = strings.Join(data, "\n")
+			received <- msg
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// newMailingServer returns a test server with BASE_URL set that sends its
+// email to a fake SMTP server.
+func newMailingServer(t *testing.T) (*Server, <-chan fakeMail) {
+	t.Helper()
+
+	s := newTestServer(t)
+	mailer, received := newFakeSMTP(t)
+	s.mailer = mailer
+	s.config.BaseURL = "https://points.example.org"
+	return s, received
+}
+
+// waitForMail returns the next message the fake server receives.
+func waitForMail(t *testing.T, received <-chan fakeMail) fakeMail {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return fakeMail{}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	mailer, received := newFakeSMTP(t)
+
+	if err := mailer.Send("member@example.org", "Hello", "First line\nSecond line\n"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := waitForMail(t, received)
+
+	if msg.From != "<noreply@example.org>" {
+		t.Errorf("envelope from = %q", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "<member@example.org>" {
+		t.Errorf("envelope to = %q", msg.To)
+	}
+	header, body, _ := strings.Cut(msg.Data, "\n\n")
+	for _, want := range []string{"To: member@example.org", "Subject: Hello", "Content-Type: text/plain; charset=UTF-8"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("headers %q are missing %q", header, want)
+		}
+	}
+	if body != "First line\nSecond line" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPMailerRefusesHeaderInjection(t *testing.T) {
+	mailer, _ := newFakeSMTP(t)
+
+	tests := []struct {
+		name, to, subject string
+	}{
+		{"recipient", "member@example.org\r\nBcc: victim@example.org", "Hello"},
+		{"subject", "member@example.org", "Hello\nBcc: victim@example.org"},
+	}
+
+	for _, tt := range tests {
+		if err := mailer.Send(tt.to, tt.subject, "body"); err == nil {
+			t.Errorf("%s: a newline in a header was accepted", tt.name)
+		}
+	}
+}
+
+// readMailLine reads through a message until it finds a line containing
+// marker, for pulling links out of emails.
+func readMailLine(t *testing.T, msg fakeMail, marker string) string {
+	t.Helper()
+
+	scanner := bufio.NewScanner(strings.NewReader(msg.Data))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.Contains(line, marker) {
+			return strings.TrimSpace(line)
+		}
+	}
+	t.Fatalf("no line containing %q in %q", marker, msg.Data)
+	return ""
+}
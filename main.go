@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,51 +17,79 @@ import (
 )
 
 type Server struct {
-	db       *sql.DB
-	router   *mux.Router
-	hub      *Hub
-	upgrader websocket.Upgrader
+	db            *sql.DB
+	router        *mux.Router
+	hub           *Hub
+	upgrader      websocket.Upgrader
+	sessionSecret []byte
+	config        *Config
+	mailer        Mailer
+	oidc          *oidcProvider
 }
 
 type Hub struct {
 	clients    map[*Client]bool
 	broadcast  chan []byte
+	direct     chan directMessage
 	register   chan *Client
 	unregister chan *Client
 }
 
+// directMessage goes only to the connections of the given users.
+type directMessage struct {
+	userIDs map[int]bool
+	data    []byte
+}
+
 type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+
+	// The signed-in user, or 0 for the public leaderboard
+	userID int
 }
 
 func NewServer() (*Server, error) {
+	config := loadConfig()
+
 	db, err := initDB()
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
 
+	oidc, err := newOIDCProvider(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC configuration: %w", err)
+	}
+
+	sessionSecret, err := loadSessionSecret(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session secret: %w", err)
+	}
+
 	hub := &Hub{
 		clients:    make(map[*Client]bool),
 		broadcast:  make(chan []byte),
+		direct:     make(chan directMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 	}
 
 	s := &Server{
-		db:     db,
-		router: mux.NewRouter(),
-		hub:    hub,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
+		db:            db,
+		router:        mux.NewRouter(),
+		hub:           hub,
+		sessionSecret: sessionSecret,
+		config:        config,
+		mailer:        newMailer(config),
+		oidc:          oidc,
 	}
+	s.upgrader = websocket.Upgrader{CheckOrigin: s.checkWebSocketOrigin}
 
 	s.setupRoutes()
 	go s.hub.run()
+	go s.cleanupSessions()
 
 	return s, nil
 }
@@ -87,6 +117,19 @@ func (h *Hub) run() {
 					delete(h.clients, client)
 				}
 			}
+
+		case message := <-h.direct:
+			for client := range h.clients {
+				if !message.userIDs[client.userID] {
+					continue
+				}
+				select {
+				case client.send <- message.data:
+				default:
+					close(client.send)
+					delete(h.clients, client)
+				}
+			}
 		}
 	}
 }
@@ -99,24 +142,80 @@ func (s *Server) setupRoutes() {
 	s.router.HandleFunc("/", s.handleHome).Methods("GET")
 	s.router.HandleFunc("/submit-points", s.handleSubmitPointsPage).Methods("GET")
 	s.router.HandleFunc("/login", s.handleLoginPage).Methods("GET")
+	s.router.HandleFunc("/login/oidc", s.handleOIDCStart).Methods("GET")
+	s.router.HandleFunc("/login/oidc/callback", s.handleOIDCCallback).Methods("GET")
 	s.router.HandleFunc("/admin", s.handleAdminPage).Methods("GET")
 	s.router.HandleFunc("/ward-log", s.handleWardLogPage).Methods("GET")
+	s.router.HandleFunc("/reset-password", s.handleResetPasswordPage).Methods("GET")
+	s.router.HandleFunc("/accept-invite", s.handleAcceptInvitePage).Methods("GET")
+	s.router.HandleFunc("/receipt", s.handleReceiptPage).Methods("GET")
 	
 	// API endpoints
 	api := s.router.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/points", s.handleSubmitPoints).Methods("POST")
-	api.HandleFunc("/points/{id}/approve", s.handleApprovePoints).Methods("POST")
-	api.HandleFunc("/points/{id}/reject", s.handleRejectPoints).Methods("POST")
-	api.HandleFunc("/leaderboard", s.handleGetLeaderboard).Methods("GET")
+	api.Use(s.csrfMiddleware)
+	api.HandleFunc("/points", s.withTokenScope(permCreateSubmissions, s.handleSubmitPoints)).Methods("POST")
+	api.HandleFunc("/points/bulk", s.withTokenScope(permApproveSubmissions, s.handleBulkDecision)).Methods("POST")
+	api.HandleFunc("/points/{id}/approve", s.withTokenScope(permApproveSubmissions, s.handleApprovePoints)).Methods("POST")
+	api.HandleFunc("/points/{id}/reject", s.withTokenScope(permApproveSubmissions, s.handleRejectPoints)).Methods("POST")
+	api.HandleFunc("/points/{id}/edits", s.withTokenScope(permViewSubmissions, s.handleGetSubmissionEdits)).Methods("GET")
+	api.HandleFunc("/receipts/{code}", s.handleGetReceipt).Methods("GET")
+	api.HandleFunc("/receipts/{code}", s.handleAmendReceipt).Methods("POST")
+	api.HandleFunc("/receipts/{code}/withdraw", s.handleWithdrawReceipt).Methods("POST")
+	api.HandleFunc("/settings/ordinance-categories", s.handleOrdinanceCategories).Methods("GET", "POST")
+	api.HandleFunc("/receipts/{code}/comments", s.handleReceiptComment).Methods("POST")
+	api.HandleFunc("/points/{id}/comments", s.withTokenScope(permViewSubmissions, s.handleGetSubmissionComments)).Methods("GET")
+	api.HandleFunc("/points/{id}/comments", s.withTokenScope(permApproveSubmissions, s.handlePostSubmissionComment)).Methods("POST")
+	api.HandleFunc("/points/{id}/reverse", s.withTokenScope(permApproveSubmissions, s.handleReversePoints)).Methods("POST")
+	api.HandleFunc("/leaderboard", s.withTokenScope(permReadLeaderboard, s.handleGetLeaderboard)).Methods("GET")
 	api.HandleFunc("/auth/status", s.handleAuthStatus).Methods("GET")
 	api.HandleFunc("/login", s.handleLogin).Methods("POST")
+	api.HandleFunc("/login/2fa", s.handleLoginTwoFactor).Methods("POST")
+	api.HandleFunc("/login/oidc", s.handleOIDCLogin).Methods("POST")
+	api.HandleFunc("/login/magic", s.handleRequestMagicLink).Methods("POST")
+	api.HandleFunc("/login/magic/verify", s.handleMagicLinkLogin).Methods("POST")
+	api.HandleFunc("/password-reset/request", s.handleRequestPasswordReset).Methods("POST")
+	api.HandleFunc("/password-reset/confirm", s.handleConfirmPasswordReset).Methods("POST")
 	api.HandleFunc("/logout", s.handleLogout).Methods("POST")
 	api.HandleFunc("/user", s.handleGetUser).Methods("GET")
-	api.HandleFunc("/submissions", s.handleGetSubmissions).Methods("GET")
+	api.HandleFunc("/submissions", s.withTokenScope(permViewSubmissions, s.handleGetSubmissions)).Methods("GET")
 	api.HandleFunc("/ward/{id}/log", s.handleGetWardLog).Methods("GET")
+	api.HandleFunc("/ward/{id}/categories", s.withTokenScope(permReadLeaderboard, s.handleGetWardCategories)).Methods("GET")
+	api.HandleFunc("/ward/{id}/ledger", s.handleGetWardLedger).Methods("GET")
+	api.HandleFunc("/ward/{id}/adjustments", s.handleAdjustWardPoints).Methods("POST")
+	api.HandleFunc("/ledger/rebuild", s.handleRebuildWardTotals).Methods("POST")
+	api.HandleFunc("/integrity", s.handleIntegrityCheck).Methods("GET", "POST")
 	api.HandleFunc("/wards", s.handleGetWards).Methods("GET")
 	api.HandleFunc("/create-user", s.handleCreateUser).Methods("POST")
 	api.HandleFunc("/update-profile", s.handleUpdateProfile).Methods("POST")
+	api.HandleFunc("/sessions", s.handleListSessions).Methods("GET")
+	api.HandleFunc("/sessions/revoke-others", s.handleRevokeOtherSessions).Methods("POST")
+	api.HandleFunc("/sessions/{id}", s.handleRevokeSession).Methods("DELETE")
+	api.HandleFunc("/users", s.handleListUsers).Methods("GET")
+	api.HandleFunc("/users/{id}", s.handleUpdateUser).Methods("POST")
+	api.HandleFunc("/users/{id}", s.handleDeleteUser).Methods("DELETE")
+	api.HandleFunc("/users/{id}/disable", s.handleDisableUser).Methods("POST")
+	api.HandleFunc("/users/{id}/enable", s.handleEnableUser).Methods("POST")
+	api.HandleFunc("/users/{id}/logout", s.handleForceLogout).Methods("POST")
+	api.HandleFunc("/users/{id}/unlock", s.handleUnlockUser).Methods("POST")
+	api.HandleFunc("/users/{id}/2fa/reset", s.handleResetTwoFactor).Methods("POST")
+	api.HandleFunc("/2fa", s.handleTwoFactorStatus).Methods("GET")
+	api.HandleFunc("/2fa/setup", s.handleTwoFactorSetup).Methods("POST")
+	api.HandleFunc("/2fa/enable", s.handleTwoFactorEnable).Methods("POST")
+	api.HandleFunc("/2fa/disable", s.handleTwoFactorDisable).Methods("POST")
+	api.HandleFunc("/2fa/recovery-codes", s.handleRegenerateRecoveryCodes).Methods("POST")
+	api.HandleFunc("/settings/2fa", s.handleTwoFactorPolicy).Methods("GET", "POST")
+	api.HandleFunc("/settings/magic-link", s.handleMagicLinkPolicy).Methods("GET", "POST")
+	api.HandleFunc("/settings/rejection-reasons", s.handleRejectionReasons).Methods("GET", "POST")
+	api.HandleFunc("/settings/competition", s.handleCompetitionDates).Methods("GET", "POST")
+	api.HandleFunc("/invitations", s.handleListInvitations).Methods("GET")
+	api.HandleFunc("/invitations", s.handleCreateInvitation).Methods("POST")
+	api.HandleFunc("/invitations/accept", s.handleGetInvitation).Methods("GET")
+	api.HandleFunc("/invitations/accept", s.handleAcceptInvitation).Methods("POST")
+	api.HandleFunc("/invitations/{id}/resend", s.handleResendInvitation).Methods("POST")
+	api.HandleFunc("/invitations/{id}", s.handleRevokeInvitation).Methods("DELETE")
+	api.HandleFunc("/tokens", s.handleListAPITokens).Methods("GET")
+	api.HandleFunc("/tokens", s.handleCreateAPIToken).Methods("POST")
+	api.HandleFunc("/tokens/{id}", s.handleRevokeAPIToken).Methods("DELETE")
 	
 	// WebSocket endpoint
 	s.router.HandleFunc("/ws", s.handleWebSocket)
@@ -142,6 +241,49 @@ func (s *Server) handleWardLogPage(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "ward-log.html")
 }
 
+func (s *Server) handleResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "reset-password.html")
+}
+
+func (s *Server) handleAcceptInvitePage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "accept-invite.html")
+}
+
+func (s *Server) handleReceiptPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "receipt.html")
+}
+
+// checkWebSocketOrigin only lets pages from this site open the socket. It
+// signs in with the session cookie and carries private comments, so another
+// site mustn't be able to open it from a signed-in user's browser. Clients
+// that send no Origin aren't browsers and can't ride anyone's cookie.
+func (s *Server) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	// Behind a proxy that rewrites Host, the configured address is the one
+	// pages are served from
+	if s.config.BaseURL != "" {
+		base, err := url.Parse(s.config.BaseURL)
+		if err == nil && strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -150,9 +292,10 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		hub:  s.hub,
-		conn: conn,
-		send: make(chan []byte, 256),
+		hub:    s.hub,
+		conn:   conn,
+		send:   make(chan []byte, 256),
+		userID: s.getUserIDFromSession(r),
 	}
 
 	client.hub.register <- client
@@ -234,7 +377,33 @@ func (s *Server) broadcastUpdate(updateType string, data interface{}) {
 	s.hub.broadcast <- jsonData
 }
 
+// notifyUsers sends an update only to the given users' open connections.
+func (s *Server) notifyUsers(userIDs []int, updateType string, data interface{}) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"type": updateType,
+		"data": data,
+	})
+	if err != nil {
+		log.Printf("Error marshaling notification data: %v", err)
+		return
+	}
+
+	message := directMessage{userIDs: map[int]bool{}, data: jsonData}
+	for _, id := range userIDs {
+		message.userIDs[id] = true
+	}
+	s.hub.direct <- message
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheckCommand(os.Args[2:]))
+	}
+
 	server, err := NewServer()
 	if err != nil {
 		log.Fatal(err)
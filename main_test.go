@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of every user made by createTestUser.
+const testPassword = "correct horse battery"
+
+// newTestServer returns a server with its routes set up, backed by a fresh,
+// seeded database in a temporary directory, with its hub running.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "templepoints.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := createTables(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedData(db); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := &Hub{
+		clients:    make(map[*Client]bool),
+		broadcast:  make(chan []byte),
+		direct:     make(chan directMessage),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+	}
+	go hub.run()
+
+	s := &Server{
+		db:            db,
+		router:        mux.NewRouter(),
+		hub:           hub,
+		sessionSecret: []byte("test session secret"),
+		config:        &Config{},
+	}
+	s.setupRoutes()
+	return s
+}
+
+// createTestUser adds an enabled user with testPassword and returns their ID.
+func createTestUser(t *testing.T, s *Server, email, role string, wardIDs ...int) int {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.db.Exec(`INSERT INTO users (email, password, role) VALUES (?, ?, ?)`, email, hash, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+
+	for _, wardID := range wardIDs {
+		if _, err := s.db.Exec(`INSERT INTO user_wards (user_id, ward_id) VALUES (?, ?)`, id, wardID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return int(id)
+}
+
+// testClient sends requests through the server's router like a browser:
+// it keeps the cookies it's given and echoes the CSRF cookie back in the
+// X-CSRF-Token header as the pages do.
+type testClient struct {
+	t       *testing.T
+	s       *Server
+	cookies map[string]*http.Cookie
+	headers map[string]string
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	return &testClient{t: t, s: s, cookies: map[string]*http.Cookie{}, headers: map[string]string{}}
+}
+
+// do sends body, if not nil, as JSON and returns the response.
+func (c *testClient) do(method, path string, body interface{}) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	if cookie, ok := c.cookies[csrfCookieName]; ok {
+		req.Header.Set(csrfHeaderName, cookie.Value)
+	}
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+
+	rec := httptest.NewRecorder()
+	c.s.router.ServeHTTP(rec, req)
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie
+		}
+	}
+	return rec
+}
+
+// login signs in with the password and fails the test if it's refused.
+func (c *testClient) login(email, password string) {
+	c.t.Helper()
+
+	rec := c.do("POST", "/api/login", map[string]string{"email": email, "password": password})
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("login as %s: %d %s", email, rec.Code, rec.Body.String())
+	}
+}
+
+// decodeJSON decodes a response body into v.
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// submitted is what submitPoints returns about a new submission.
+type submitted struct {
+	ID          int    `json:"id"`
+	Points      int    `json:"points"`
+	ReceiptCode string `json:"receipt_code"`
+}
+
+// submitPoints makes an anonymous submission to wardID through the API,
+// claiming the given number of baptisms.
+func submitPoints(t *testing.T, s *Server, wardID, baptisms int) submitted {
+	t.Helper()
+
+	rec := newTestClient(t, s).do("POST", "/api/points", map[string]interface{}{
+		"ward_id":        wardID,
+		"submitter_name": "Test Member",
+		"items":          []SubmissionItem{{Category: "baptism", Quantity: baptisms}},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("submitting: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var sub submitted
+	decodeJSON(t, rec, &sub)
+	return sub
+}
+
+// submitUnitemized turns on allow_unitemized and submits points to wardID
+// anonymously without items.
+func submitUnitemized(t *testing.T, s *Server, wardID, points int) submitted {
+	t.Helper()
+
+	if err := setSetting(s.db, allowUnitemizedSetting, "true"); err != nil {
+		t.Fatal(err)
+	}
+	rec := newTestClient(t, s).do("POST", "/api/points", map[string]interface{}{
+		"ward_id":        wardID,
+		"submitter_name": "Test Member",
+		"points":         points,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("submitting: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var sub submitted
+	decodeJSON(t, rec, &sub)
+	return sub
+}
+
+// createAPIToken has c create a token with scopes and returns a client that
+// authenticates with it.
+func createAPIToken(t *testing.T, c *testClient, scopes ...string) *testClient {
+	t.Helper()
+
+	rec := c.do("POST", "/api/tokens", map[string]interface{}{"name": "script", "scopes": scopes})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("creating token: %d %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, rec, &created)
+
+	script := newTestClient(t, c.s)
+	script.headers["Authorization"] = "Bearer " + created.Token
+	return script
+}
+
+// wardTotals returns a ward's cached verified and pending points.
+func wardTotals(t *testing.T, s *Server, wardID int) (points, pending int) {
+	t.Helper()
+
+	err := s.db.QueryRow(`SELECT points, pending_points FROM wards WHERE id = ?`, wardID).Scan(&points, &pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points, pending
+}
+
+// pointsPath is the API path for an action on a submission.
+func pointsPath(id int, action string) string {
+	return "/api/points/" + strconv.Itoa(id) + "/" + action
+}
@@ -12,13 +12,68 @@ type Ward struct {
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// userRoles lists every value allowed in users.role, in display order. What
+// each role may do is in roleDefinitions.
+var userRoles = []string{"admin", "stake_viewer", "clerk", "ward_approver"}
+
 type User struct {
 	ID        int       `json:"id"`
 	Email     string    `json:"email"`
 	Password  string    `json:"-"`
-	Role      string    `json:"role"` // "admin" or "ward_approver"
-	WardID    *int      `json:"ward_id,omitempty"`
+	Role      string    `json:"role"`  // one of userRoles
+	Wards     []WardRef `json:"wards"` // wards a ward-scoped role covers
+	Disabled  bool      `json:"disabled"`
 	CreatedAt time.Time `json:"created_at"`
+
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+
+	// Filled in for the signed-in user so pages can decide what to show
+	StakeWide   bool     `json:"stake_wide,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// WardRef is a ward's ID and name without its totals.
+type WardRef struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+
+	// Set when the user's role requires 2FA but they haven't enrolled yet
+	TwoFactorPending bool `json:"-"`
+}
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Expired    bool       `json:"expired"`
+}
+
+type Invitation struct {
+	ID         int        `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	Wards      []WardRef  `json:"wards"` // wards a ward-scoped role will cover
+	InvitedBy  string     `json:"invited_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSentAt time.Time  `json:"last_sent_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	Expired    bool       `json:"expired"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
 }
 
 type PointSubmission struct {
@@ -26,12 +81,136 @@ type PointSubmission struct {
 	WardID        int        `json:"ward_id"`
 	WardName      string     `json:"ward_name,omitempty"`
 	SubmitterName string     `json:"submitter_name"`
-	Points        int        `json:"points"`
+	Points        int        `json:"points"` // as claimed by the submitter
 	Note          string     `json:"note"`
-	Status        string     `json:"status"` // "pending", "approved", "rejected"
+	Status        string     `json:"status"` // "pending", "needs_info", "approved", "rejected", "withdrawn"
 	ApprovedBy    *int       `json:"approved_by,omitempty"`
 	ApprovedAt    *time.Time `json:"approved_at,omitempty"`
 	CreatedAt     time.Time  `json:"created_at"`
+	ActivityDate  string     `json:"activity_date"` // YYYY-MM-DD of the temple visit
+
+	// Goes up each time the submitter amends it or it's reopened, so an
+	// approver's decision can be tied to the version they reviewed
+	Version int `json:"version"`
+
+	// Set once approved. An approver may award more or fewer points than
+	// were claimed, explaining why in the note.
+	AwardedPoints *int   `json:"awarded_points,omitempty"`
+	ApprovalNote  string `json:"approval_note,omitempty"`
+
+	// Why it was rejected, shown to the submitter in the ward log
+	RejectionReason string `json:"rejection_reason,omitempty"`
+
+	// How many times the submitter changed it while pending, and how many
+	// comments are on it
+	EditCount    int `json:"edit_count,omitempty"`
+	CommentCount int `json:"comment_count,omitempty"`
+
+	// Set when an approval was later reversed
+	ReversedAt     *time.Time `json:"reversed_at,omitempty"`
+	ReversalReason string     `json:"reversal_reason,omitempty"`
+
+	// What the points are for, when submitted by ordinance. Submissions
+	// made before itemizing, or through the API without items, have none.
+	Items []SubmissionItem `json:"items,omitempty"`
+}
+
+// OrdinanceCategory is a kind of temple ordinance in the catalog and the
+// points each one is worth.
+type OrdinanceCategory struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+}
+
+// SubmissionItem is one line of an itemized submission. PointsEach is the
+// category's value when it was submitted, and BonusPoints what the family
+// name multiplier added then, so later changes to the catalog or multiplier
+// don't change what was claimed. Points is BasePoints plus BonusPoints.
+type SubmissionItem struct {
+	Category    string `json:"category"`
+	Name        string `json:"name,omitempty"`
+	Quantity    int    `json:"quantity"`
+	FamilyNames bool   `json:"family_names"` // names the submitter's family provided
+	PointsEach  int    `json:"points_each"`
+	BasePoints  int    `json:"base_points"`
+	BonusPoints int    `json:"bonus_points"`
+	Points      int    `json:"points"`
+}
+
+// CategoryTotal is how many ordinances of one category a ward has had
+// approved, how many of those were for family names, and the points claimed
+// for them.
+type CategoryTotal struct {
+	Category    string `json:"category"`
+	Name        string `json:"name"`
+	Quantity    int    `json:"quantity"`
+	FamilyNames int    `json:"family_names"`
+	BonusPoints int    `json:"bonus_points"`
+	Points      int    `json:"points"`
+}
+
+// CategoryRank is a ward's total for one category and where that puts it
+// among the wards, 1 being the most of that ordinance.
+type CategoryRank struct {
+	CategoryTotal
+	Rank int `json:"rank"`
+}
+
+// awarded returns the points an approved submission counts for.
+func (p *PointSubmission) awarded() int {
+	if p.AwardedPoints != nil {
+		return *p.AwardedPoints
+	}
+	return p.Points
+}
+
+// undecided reports whether the submission is still waiting on an approver:
+// pending, or pending with a question out to the submitter.
+func (p *PointSubmission) undecided() bool {
+	return p.Status == "pending" || p.Status == "needs_info"
+}
+
+// SubmissionComment is one message in the thread on a submission, from an
+// approver or from the submitter through their receipt.
+type SubmissionComment struct {
+	ID            int       `json:"id"`
+	AuthorName    string    `json:"author_name"`
+	FromSubmitter bool      `json:"from_submitter"`
+	Body          string    `json:"body"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SubmissionEdit is a change a submitter made to their own pending
+// submission: "amended" or "withdrawn". OldItems and NewItems are the line
+// items before and after, as they were priced then.
+type SubmissionEdit struct {
+	ID        int              `json:"id"`
+	Action    string           `json:"action"`
+	OldPoints int              `json:"old_points"`
+	NewPoints int              `json:"new_points"`
+	OldNote   string           `json:"old_note"`
+	NewNote   string           `json:"new_note"`
+	OldItems  []SubmissionItem `json:"old_items,omitempty"`
+	NewItems  []SubmissionItem `json:"new_items,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// LedgerEntry is one change to a ward's points. VerifiedBalance and
+// PendingBalance are running totals filled in when listing a ward's ledger.
+type LedgerEntry struct {
+	ID              int       `json:"id"`
+	WardID          int       `json:"ward_id"`
+	SubmissionID    *int      `json:"submission_id,omitempty"`
+	SubmitterName   string    `json:"submitter_name,omitempty"`
+	EntryType       string    `json:"entry_type"`
+	VerifiedDelta   int       `json:"verified_delta"`
+	PendingDelta    int       `json:"pending_delta"`
+	UserID          *int      `json:"-"`
+	Note            string    `json:"note,omitempty"`
+	VerifiedBalance int       `json:"verified_balance"`
+	PendingBalance  int       `json:"pending_balance"`
+	CreatedAt       time.Time `json:"created_at"`
 }
 
 type LeaderboardEntry struct {
@@ -45,6 +224,10 @@ type LeaderboardEntry struct {
 	Achievements  []string  `json:"achievements"`
 	Streak        int       `json:"streak"`
 	LastActivity  time.Time `json:"last_activity"`
+
+	Categories []CategoryTotal `json:"categories"`
+	// Category is the ranked category's total, on a category leaderboard
+	Category *CategoryTotal `json:"category,omitempty"`
 }
 
 type Stats struct {
@@ -52,6 +235,10 @@ type Stats struct {
 	TotalPoints  int    `json:"total_points"`
 	DaysActive   int    `json:"days_active"`
 	Participants int    `json:"participants"`
+
+	// Approved ordinances for family names, and the bonus points they earned
+	FamilyNames       int `json:"family_names"`
+	FamilyBonusPoints int `json:"family_bonus_points"`
 }
 
 type Achievement struct {
@@ -66,7 +253,7 @@ type Achievement struct {
 
 type ActivityLog struct {
 	ID        int       `json:"id"`
-	WardID    int       `json:"ward_id"`
+	WardID    *int      `json:"ward_id,omitempty"`
 	UserID    *int      `json:"user_id,omitempty"`
 	Action    string    `json:"action"`
 	Details   string    `json:"details"`
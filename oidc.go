@@ -0,0 +1,643 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oidcStateCookieName = "oidc_state"
+	oidcLoginCookieName = "oidc_login"
+
+	// How long the user has to sign in at the provider
+	oidcStateTTL = 10 * time.Minute
+
+	// How long the browser has to pick up a completed sign-in
+	oidcLoginTTL = 2 * time.Minute
+
+	// Allowance for clock drift between us and the provider
+	oidcClockSkew = time.Minute
+)
+
+// oidcProvider signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. The provider's endpoints and signing
+// keys are fetched on first use and cached.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	name         string
+
+	// Accounts are created with this role the first time an unknown email
+	// signs in. Empty means unknown emails are refused.
+	defaultRole  string
+	defaultWards []int
+
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	AuthorizedBy  string       `json:"azp"`
+	Expiry        int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified interface{}  `json:"email_verified"`
+}
+
+// oidcAudience accepts an aud claim given as either a string or a list.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = []string{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// emailVerified allows for providers that send email_verified as a string.
+func (c *oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// newOIDCProvider returns nil when no issuer is configured.
+func newOIDCProvider(config *Config) (*oidcProvider, error) {
+	if config.OIDCIssuer == "" {
+		return nil, nil
+	}
+
+	if config.OIDCClientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+
+	p := &oidcProvider{
+		issuer:       strings.TrimRight(config.OIDCIssuer, "/"),
+		clientID:     config.OIDCClientID,
+		clientSecret: config.OIDCClientSecret,
+		redirectURL:  config.OIDCRedirectURL,
+		name:         config.OIDCProviderName,
+		defaultRole:  config.OIDCDefaultRole,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if p.defaultRole != "" {
+		var wardIDs []int
+		for _, field := range strings.Split(config.OIDCDefaultWards, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ward ID %q in OIDC_DEFAULT_WARDS", field)
+			}
+			wardIDs = append(wardIDs, id)
+		}
+
+		wards, msg := validateRoleAssignment(p.defaultRole, wardIDs)
+		if msg != "" {
+			return nil, fmt.Errorf("OIDC_DEFAULT_ROLE: %s", msg)
+		}
+		p.defaultWards = wards
+	}
+
+	return p, nil
+}
+
+func (p *oidcProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("provider reports issuer %q, expected %q", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("provider configuration is missing endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// publicKey returns the provider's signing key with the given ID. The key set
+// is refetched when an unknown key turns up, at most once a minute, so key
+// rotation is picked up without a restart.
+func (p *oidcProvider) publicKey(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetchedAt = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// exchangeCode trades an authorization code for the user's ID token.
+func (p *oidcProvider) exchangeCode(d *oidcDiscovery, code, verifier, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s: %s", resp.Status, body)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return token.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's RS256 signature, issuer, audience,
+// expiry and nonce and returns its claims.
+func (p *oidcProvider) verifyIDToken(d *oidcDiscovery, raw, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+
+	key, err := p.publicKey(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims oidcClaims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("ID token issuer %q doesn't match", claims.Issuer)
+	case !claims.Audience.contains(p.clientID):
+		return nil, errors.New("ID token wasn't issued to this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.clientID:
+		return nil, errors.New("ID token wasn't authorized for this client")
+	case time.Now().Add(-oidcClockSkew).Unix() > claims.Expiry:
+		return nil, errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+
+	return &claims, nil
+}
+
+func (p *oidcProvider) callbackURL(s *Server, r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	return s.baseURL(r) + "/login/oidc/callback"
+}
+
+// consumeOIDCToken records that a state or completed sign-in has been used,
+// reporting false if it already had been. The cookies that carry them are
+// signed but can't be revoked, so this is what makes them single-use.
+func (s *Server) consumeOIDCToken(token string, expires int64) bool {
+	_, err := s.db.Exec(`
+		INSERT INTO oidc_used_tokens (token_hash, expires_at) VALUES (?, datetime(?, 'unixepoch'))
+	`, hashToken(token), expires)
+	if err != nil {
+		if !strings.Contains(err.Error(), "UNIQUE constraint") {
+			log.Printf("Error recording OIDC token use: %v", err)
+		}
+		return false
+	}
+	return true
+}
+
+// oidcFailed sends the browser back to the login page with a message.
+func oidcFailed(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/login?oidc_error="+url.QueryEscape(message), http.StatusFound)
+}
+
+// Send the browser to the provider to sign in
+func (s *Server) handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	d, err := s.oidc.getDiscovery()
+	if err != nil {
+		log.Printf("Error loading OIDC provider configuration: %v", err)
+		oidcFailed(w, r, fmt.Sprintf("%s sign-in is unavailable right now", s.oidc.name))
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		if values[i], err = generateToken(32); err != nil {
+			http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+			return
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	expires := time.Now().Add(oidcStateTTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    s.signValue(fmt.Sprintf("%s:%s:%s:%d", state, nonce, verifier, expires)),
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.oidc.clientID},
+		"redirect_uri":          {s.oidc.callbackURL(s, r)},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+separator+params.Encode(), http.StatusFound)
+}
+
+// The provider sends the browser back here. Once the ID token checks out the
+// user is handed to the login page, which finishes signing in through
+// /api/login/oidc so 2FA works as it does for passwords.
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The state cookie is single-use
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("OIDC sign-in refused by provider: %s %s", errCode, query.Get("error_description"))
+		oidcFailed(w, r, fmt.Sprintf("%s sign-in was cancelled or refused", s.oidc.name))
+		return
+	}
+
+	var state, nonce, verifier string
+	var expires int64
+	if cookie, err := r.Cookie(oidcStateCookieName); err == nil {
+		if value, ok := s.verifySignedValue(cookie.Value); ok {
+			parts := strings.Split(value, ":")
+			if len(parts) == 4 {
+				expires, err = strconv.ParseInt(parts[3], 10, 64)
+				if err == nil && time.Now().Unix() <= expires {
+					state, nonce, verifier = parts[0], parts[1], parts[2]
+				}
+			}
+		}
+	}
+	if state == "" || query.Get("state") != state {
+		oidcFailed(w, r, "Your sign-in session expired. Please try again.")
+		return
+	}
+
+	// Clearing the cookie doesn't stop a copy of it being sent again
+	if !s.consumeOIDCToken("state:"+state, expires) {
+		oidcFailed(w, r, "Your sign-in session expired. Please try again.")
+		return
+	}
+
+	d, err := s.oidc.getDiscovery()
+	if err != nil {
+		log.Printf("Error loading OIDC provider configuration: %v", err)
+		oidcFailed(w, r, fmt.Sprintf("%s sign-in is unavailable right now", s.oidc.name))
+		return
+	}
+
+	idToken, err := s.oidc.exchangeCode(d, query.Get("code"), verifier, s.oidc.callbackURL(s, r))
+	if err != nil {
+		log.Printf("Error exchanging OIDC code: %v", err)
+		oidcFailed(w, r, fmt.Sprintf("%s sign-in failed", s.oidc.name))
+		return
+	}
+
+	claims, err := s.oidc.verifyIDToken(d, idToken, nonce)
+	if err != nil {
+		log.Printf("Error verifying OIDC ID token: %v", err)
+		oidcFailed(w, r, fmt.Sprintf("%s sign-in failed", s.oidc.name))
+		return
+	}
+
+	userID, message := s.oidcUser(claims)
+	if userID == 0 {
+		oidcFailed(w, r, message)
+		return
+	}
+
+	// The random ID lets /api/login/oidc accept this cookie only once
+	loginID, err := generateToken(16)
+	if err != nil {
+		oidcFailed(w, r, "Sign-in failed. Please try again.")
+		return
+	}
+
+	loginExpires := time.Now().Add(oidcLoginTTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Value:    s.signValue(fmt.Sprintf("oidc:%d:%d:%s", userID, loginExpires, loginID)),
+		Path:     "/api/login/oidc",
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+	})
+
+	http.Redirect(w, r, "/login?oidc=1", http.StatusFound)
+}
+
+// oidcUser finds the account for a verified email, creating one when a
+// default role is configured. It returns 0 and a message for the user if
+// they can't sign in.
+func (s *Server) oidcUser(claims *oidcClaims) (int, string) {
+	email := strings.TrimSpace(claims.Email)
+	if email == "" || !claims.emailVerified() {
+		return 0, fmt.Sprintf("Your %s account doesn't have a verified email address", s.oidc.name)
+	}
+
+	var userID int
+	err := s.db.QueryRow(`SELECT id FROM users WHERE email = ? COLLATE NOCASE`, email).Scan(&userID)
+	if err == nil {
+		return userID, ""
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Error looking up OIDC user: %v", err)
+		return 0, "Sign-in failed. Please try again."
+	}
+
+	if s.oidc.defaultRole == "" {
+		return 0, fmt.Sprintf("There's no account for %s. Ask your stake administrator for an invitation.", email)
+	}
+
+	userID, err = s.provisionOIDCUser(email)
+	if err != nil {
+		log.Printf("Error creating OIDC user: %v", err)
+		return 0, "Sign-in failed. Please try again."
+	}
+	return userID, ""
+}
+
+func (s *Server) provisionOIDCUser(email string) (int, error) {
+	// The account has no usable password until the user resets it
+	random, err := generateToken(32)
+	if err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(random), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO users (email, password, role) VALUES (?, ?, ?)
+	`, email, string(hashedPassword), s.oidc.defaultRole)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+
+	if err := setUserWards(tx, userID, s.oidc.defaultWards); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.logActivity(s.logWardForUser(userID), &userID, "user_provisioned",
+		fmt.Sprintf("Created %s account for %s via %s",
+			roleDefinitions[s.oidc.defaultRole].Label, email, s.oidc.name), 0)
+
+	return userID, nil
+}
+
+// Finish an OIDC sign-in started by handleOIDCCallback
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcLoginCookieName)
+	if err != nil {
+		http.Error(w, "No sign-in in progress", http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Value:    "",
+		Path:     "/api/login/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+
+	var userID int
+	if value, ok := s.verifySignedValue(cookie.Value); ok {
+		parts := strings.Split(value, ":")
+		if len(parts) == 4 && parts[0] == "oidc" {
+			expires, err := strconv.ParseInt(parts[2], 10, 64)
+			if err == nil && time.Now().Unix() <= expires && s.consumeOIDCToken("login:"+parts[3], expires) {
+				userID, _ = strconv.Atoi(parts[1])
+			}
+		}
+	}
+	if userID == 0 {
+		http.Error(w, "Your sign-in session expired. Please try again.", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	err = s.db.QueryRow(`
+		SELECT id, email, role, totp_enabled, disabled
+		FROM users
+		WHERE id = ?
+	`, userID).Scan(&user.ID, &user.Email, &user.Role, &user.TwoFactorEnabled, &user.Disabled)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	s.finishLogin(w, r, user)
+}
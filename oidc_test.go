@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		issuer   = "https://idp.example.org"
+		clientID = "templepoints"
+		nonce    = "the-nonce"
+	)
+	d := &oidcDiscovery{Issuer: issuer}
+
+	// The keys are already cached, so an unknown kid fails without a fetch
+	p := &oidcProvider{
+		clientID:      clientID,
+		keys:          map[string]*rsa.PublicKey{"k1": &key.PublicKey},
+		keysFetchedAt: time.Now(),
+	}
+
+	sign := func(header, claims map[string]interface{}, signer *rsa.PrivateKey) string {
+		encode := func(v interface{}) string {
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return base64.RawURLEncoding.EncodeToString(b)
+		}
+		signingInput := encode(header) + "." + encode(claims)
+		digest := sha256.Sum256([]byte(signingInput))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   issuer,
+			"sub":   "user-1",
+			"aud":   clientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": nonce,
+			"email": "member@example.org",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", sign(rs256, claims(nil), key), false},
+		{"audience list with azp", sign(rs256, claims(map[string]interface{}{
+			"aud": []string{clientID, "other"}, "azp": clientID}), key), false},
+		{"single audience list without azp", sign(rs256, claims(map[string]interface{}{
+			"aud": []string{clientID}}), key), false},
+		{"expired within clock skew", sign(rs256, claims(map[string]interface{}{
+			"exp": time.Now().Add(-oidcClockSkew / 2).Unix()}), key), false},
+		{"wrong issuer", sign(rs256, claims(map[string]interface{}{"iss": "https://evil.example.org"}), key), true},
+		{"wrong audience", sign(rs256, claims(map[string]interface{}{"aud": "other"}), key), true},
+		{"audience list without azp", sign(rs256, claims(map[string]interface{}{
+			"aud": []string{clientID, "other"}}), key), true},
+		{"audience list with another azp", sign(rs256, claims(map[string]interface{}{
+			"aud": []string{clientID, "other"}, "azp": "other"}), key), true},
+		{"expired", sign(rs256, claims(map[string]interface{}{
+			"exp": time.Now().Add(-2 * oidcClockSkew).Unix()}), key), true},
+		{"no expiry", sign(rs256, claims(map[string]interface{}{"exp": nil}), key), true},
+		{"wrong nonce", sign(rs256, claims(map[string]interface{}{"nonce": "replayed"}), key), true},
+		{"missing nonce", sign(rs256, claims(map[string]interface{}{"nonce": nil}), key), true},
+		{"signed by another key", sign(rs256, claims(nil), otherKey), true},
+		{"unknown key", sign(map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil), key), true},
+		{"alg none", sign(map[string]interface{}{"alg": "none", "kid": "k1"}, claims(nil), key), true},
+		{"alg HS256", sign(map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims(nil), key), true},
+		{"malformed", "not-a-jwt", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.verifyIDToken(d, tt.token, nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("verifyIDToken accepted the token: %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyIDToken: %v", err)
+			}
+			if got.Subject != "user-1" || got.Email != "member@example.org" {
+				t.Errorf("claims = %+v", got)
+			}
+		})
+	}
+}
+
+func TestConsumeOIDCToken(t *testing.T) {
+	s := newTestServer(t)
+	expires := time.Now().Add(time.Minute).Unix()
+
+	if !s.consumeOIDCToken("state-1", expires) {
+		t.Fatal("first use of a state was refused")
+	}
+	if s.consumeOIDCToken("state-1", expires) {
+		t.Error("a state was accepted twice")
+	}
+	if !s.consumeOIDCToken("state-2", expires) {
+		t.Error("a different state was refused")
+	}
+}
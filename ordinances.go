@@ -0,0 +1,507 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	ordinanceCategoriesSetting  = "ordinance_categories"
+	familyNameMultiplierSetting = "family_name_multiplier"
+	allowUnitemizedSetting      = "allow_unitemized_submissions"
+)
+
+// defaultFamilyNameMultiplier doubles the points for ordinances done for the
+// submitter's own family names.
+const defaultFamilyNameMultiplier = 2.0
+
+// maxFamilyNameMultiplier keeps a typo from swamping the leaderboard.
+const maxFamilyNameMultiplier = 10.0
+
+// maxItemQuantity and maxSubmissionPoints bound what one anonymous
+// submission can claim, far above any real temple trip, so a typo or a
+// hostile client can't put an absurd (or overflowing) total in pending.
+const (
+	maxItemQuantity     = 1000
+	maxSubmissionPoints = 100000
+)
+
+// defaultOrdinanceCategories are used until an admin sets their own catalog.
+var defaultOrdinanceCategories = []OrdinanceCategory{
+	{Key: "baptism", Name: "Baptism", Points: 1},
+	{Key: "confirmation", Name: "Confirmation", Points: 1},
+	{Key: "initiatory", Name: "Initiatory", Points: 1},
+	{Key: "endowment", Name: "Endowment", Points: 1},
+	{Key: "sealing", Name: "Sealing", Points: 1},
+}
+
+var categoryKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// ordinanceCategories returns the catalog submissions are itemized against,
+// in the order they're shown.
+func (s *Server) ordinanceCategories() []OrdinanceCategory {
+	value, err := getSetting(s.db, ordinanceCategoriesSetting)
+	if err != nil {
+		return defaultOrdinanceCategories
+	}
+
+	var categories []OrdinanceCategory
+	if err := json.Unmarshal([]byte(value), &categories); err != nil {
+		log.Printf("Error reading ordinance categories: %v", err)
+		return defaultOrdinanceCategories
+	}
+	return categories
+}
+
+// familyNameMultiplier returns what family name ordinances are multiplied by.
+func (s *Server) familyNameMultiplier() float64 {
+	value, err := getSetting(s.db, familyNameMultiplierSetting)
+	if err != nil {
+		return defaultFamilyNameMultiplier
+	}
+
+	multiplier, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Error reading family name multiplier: %v", err)
+		return defaultFamilyNameMultiplier
+	}
+	return multiplier
+}
+
+// unitemizedAllowed reports whether an admin has allowed submissions that
+// claim a number of points without listing ordinances. They're off until
+// enabled, since their points aren't priced from the catalog.
+func (s *Server) unitemizedAllowed() bool {
+	value, err := getSetting(s.db, allowUnitemizedSetting)
+	return err == nil && value == "true"
+}
+
+// categoryNames maps each category key in the catalog to its name.
+func categoryNames(catalog []OrdinanceCategory) map[string]string {
+	names := make(map[string]string, len(catalog))
+	for _, c := range catalog {
+		names[c.Key] = c.Name
+	}
+	return names
+}
+
+// View the ordinance catalog, family name multiplier and whether un-itemized
+// submissions are allowed (anyone), or change any of them (admin only)
+func (s *Server) handleOrdinanceCategories(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		userID := s.getUserIDFromSession(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !s.isAdmin(userID) {
+			http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Categories           []OrdinanceCategory `json:"categories"`
+			FamilyNameMultiplier *float64            `json:"family_name_multiplier"`
+			AllowUnitemized      *bool               `json:"allow_unitemized"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Categories == nil && req.FamilyNameMultiplier == nil && req.AllowUnitemized == nil {
+			http.Error(w, "Nothing to change", http.StatusBadRequest)
+			return
+		}
+
+		if m := req.FamilyNameMultiplier; m != nil && (*m < 1 || *m > maxFamilyNameMultiplier) {
+			http.Error(w, fmt.Sprintf("The family name multiplier must be between 1 and %g", maxFamilyNameMultiplier),
+				http.StatusBadRequest)
+			return
+		}
+
+		if req.Categories != nil {
+			if msg := validateCategories(req.Categories); msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+
+			value, _ := json.Marshal(req.Categories)
+			if err := setSetting(s.db, ordinanceCategoriesSetting, string(value)); err != nil {
+				log.Printf("Error saving ordinance categories: %v", err)
+				http.Error(w, "Failed to save ordinance categories", http.StatusInternalServerError)
+				return
+			}
+
+			summary := make([]string, len(req.Categories))
+			for i, c := range req.Categories {
+				summary[i] = fmt.Sprintf("%s %d", c.Name, c.Points)
+			}
+			s.logActivity(0, &userID, "ordinance_categories_changed",
+				fmt.Sprintf("Ordinance point values set to: %s", strings.Join(summary, ", ")), 0)
+		}
+
+		if req.FamilyNameMultiplier != nil {
+			value := strconv.FormatFloat(*req.FamilyNameMultiplier, 'f', -1, 64)
+			if err := setSetting(s.db, familyNameMultiplierSetting, value); err != nil {
+				log.Printf("Error saving family name multiplier: %v", err)
+				http.Error(w, "Failed to save family name multiplier", http.StatusInternalServerError)
+				return
+			}
+
+			s.logActivity(0, &userID, "family_name_multiplier_changed",
+				fmt.Sprintf("Family name multiplier set to %s", value), 0)
+		}
+
+		if req.AllowUnitemized != nil {
+			if err := setSetting(s.db, allowUnitemizedSetting, strconv.FormatBool(*req.AllowUnitemized)); err != nil {
+				log.Printf("Error saving un-itemized submission setting: %v", err)
+				http.Error(w, "Failed to save un-itemized submission setting", http.StatusInternalServerError)
+				return
+			}
+
+			s.logActivity(0, &userID, "allow_unitemized_changed",
+				fmt.Sprintf("Un-itemized submissions allowed: %t", *req.AllowUnitemized), 0)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"categories":             s.ordinanceCategories(),
+		"family_name_multiplier": s.familyNameMultiplier(),
+		"allow_unitemized":       s.unitemizedAllowed(),
+	})
+}
+
+// validateCategories tidies a new catalog in place, returning what's wrong
+// with it or "" if it's fine.
+func validateCategories(categories []OrdinanceCategory) string {
+	if len(categories) == 0 {
+		return "At least one category is required"
+	}
+
+	seen := map[string]bool{}
+	for i := range categories {
+		c := &categories[i]
+		c.Key = strings.TrimSpace(c.Key)
+		c.Name = strings.TrimSpace(c.Name)
+
+		if !categoryKeyPattern.MatchString(c.Key) {
+			return fmt.Sprintf("Invalid category key %q: use lowercase letters, digits and underscores", c.Key)
+		}
+		if seen[c.Key] {
+			return fmt.Sprintf("Category %q is listed twice", c.Key)
+		}
+		seen[c.Key] = true
+
+		if c.Name == "" || c.Points <= 0 {
+			return fmt.Sprintf("Category %q needs a name and a positive point value", c.Key)
+		}
+	}
+	return ""
+}
+
+// priceItems checks a submission's line items against the catalog and works
+// out what each is worth, multiplying family name lines by multiplier. Lines
+// for the same category (and family name flag) are combined, and the result
+// is in catalog order. It returns the items and their total points, or an
+// error if a line has more than maxItemQuantity ordinances or the total is
+// more than maxSubmissionPoints.
+func priceItems(catalog []OrdinanceCategory, multiplier float64, requested []SubmissionItem) ([]SubmissionItem, int, error) {
+	type line struct {
+		category    string
+		familyNames bool
+	}
+
+	quantities := map[line]int{}
+	for _, item := range requested {
+		if item.Quantity <= 0 {
+			return nil, 0, fmt.Errorf("quantity for %q must be positive", item.Category)
+		}
+		key := line{item.Category, item.FamilyNames}
+		if item.Quantity > maxItemQuantity-quantities[key] {
+			return nil, 0, fmt.Errorf("quantity for %q can be at most %d", item.Category, maxItemQuantity)
+		}
+		quantities[key] += item.Quantity
+	}
+
+	var items []SubmissionItem
+	total := 0
+	for _, c := range catalog {
+		for _, familyNames := range []bool{false, true} {
+			key := line{c.Key, familyNames}
+			quantity, ok := quantities[key]
+			if !ok {
+				continue
+			}
+			delete(quantities, key)
+
+			if c.Points > maxSubmissionPoints/quantity {
+				return nil, 0, fmt.Errorf("a submission can be worth at most %d points", maxSubmissionPoints)
+			}
+			item := SubmissionItem{
+				Category:    c.Key,
+				Name:        c.Name,
+				Quantity:    quantity,
+				FamilyNames: familyNames,
+				PointsEach:  c.Points,
+				BasePoints:  quantity * c.Points,
+			}
+			if familyNames {
+				item.BonusPoints = int(math.Round(float64(item.BasePoints) * (multiplier - 1)))
+			}
+			item.Points = item.BasePoints + item.BonusPoints
+
+			items = append(items, item)
+			total += item.Points
+			if total > maxSubmissionPoints {
+				return nil, 0, fmt.Errorf("a submission can be worth at most %d points", maxSubmissionPoints)
+			}
+		}
+	}
+
+	for key := range quantities {
+		return nil, 0, fmt.Errorf("unknown ordinance category %q", key.category)
+	}
+	return items, total, nil
+}
+
+// sameItems reports whether two priced item lists claim the same ordinances.
+func sameItems(a, b []SubmissionItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Category != b[i].Category || a[i].Quantity != b[i].Quantity || a[i].FamilyNames != b[i].FamilyNames {
+			return false
+		}
+	}
+	return true
+}
+
+// submissionHasItems reports whether a submission is itemized.
+func submissionHasItems(q rowQuerier, submissionID int) (bool, error) {
+	var itemized bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM submission_items WHERE submission_id = ?)`, submissionID).
+		Scan(&itemized)
+	return itemized, err
+}
+
+// replaceSubmissionItems sets a submission's line items inside tx.
+func replaceSubmissionItems(tx *sql.Tx, submissionID int, items []SubmissionItem) error {
+	if _, err := tx.Exec(`DELETE FROM submission_items WHERE submission_id = ?`, submissionID); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		_, err := tx.Exec(`
+			INSERT INTO submission_items (submission_id, category, quantity, points_each, family_names, bonus_points)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, submissionID, item.Category, item.Quantity, item.PointsEach, item.FamilyNames, item.BonusPoints)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submissionItems loads the line items of the given submissions, keyed by
+// submission ID.
+func (s *Server) submissionItems(submissionIDs []int) (map[int][]SubmissionItem, error) {
+	items := map[int][]SubmissionItem{}
+	if len(submissionIDs) == 0 {
+		return items, nil
+	}
+
+	placeholders := make([]string, len(submissionIDs))
+	args := make([]interface{}, len(submissionIDs))
+	for i, id := range submissionIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := s.db.Query(`
+		SELECT submission_id, category, quantity, points_each, family_names, bonus_points
+		FROM submission_items
+		WHERE submission_id IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := categoryNames(s.ordinanceCategories())
+	for rows.Next() {
+		var id int
+		var item SubmissionItem
+		err := rows.Scan(&id, &item.Category, &item.Quantity, &item.PointsEach, &item.FamilyNames, &item.BonusPoints)
+		if err != nil {
+			return nil, err
+		}
+		item.Name = names[item.Category]
+		item.BasePoints = item.Quantity * item.PointsEach
+		item.Points = item.BasePoints + item.BonusPoints
+		items[id] = append(items[id], item)
+	}
+	return items, rows.Err()
+}
+
+// attachSubmissionItems fills in Items on each submission.
+func (s *Server) attachSubmissionItems(submissions []PointSubmission) error {
+	ids := make([]int, len(submissions))
+	for i, sub := range submissions {
+		ids[i] = sub.ID
+	}
+
+	items, err := s.submissionItems(ids)
+	if err != nil {
+		return err
+	}
+	for i := range submissions {
+		submissions[i].Items = items[submissions[i].ID]
+	}
+	return nil
+}
+
+// categoryTotals adds up the line items of approved submissions by ward and
+// category, including the family name bonus. Every category in the catalog
+// is listed for every ward, even at zero, followed by any that have since
+// been removed from the catalog. A wardID of 0 totals every ward.
+func (s *Server) categoryTotals(wardID int) (map[int][]CategoryTotal, error) {
+	query := `
+		SELECT w.id, i.category, COALESCE(SUM(i.quantity), 0),
+		       COALESCE(SUM(CASE WHEN i.family_names = 1 THEN i.quantity END), 0),
+		       COALESCE(SUM(i.bonus_points), 0),
+		       COALESCE(SUM(i.quantity * i.points_each + i.bonus_points), 0)
+		FROM wards w
+		LEFT JOIN point_submissions p ON p.ward_id = w.id AND p.status = 'approved'
+		LEFT JOIN submission_items i ON i.submission_id = p.id
+	`
+	var args []interface{}
+	if wardID != 0 {
+		query += ` WHERE w.id = ?`
+		args = append(args, wardID)
+	}
+	query += ` GROUP BY w.id, i.category ORDER BY w.id, i.category`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	catalog := s.ordinanceCategories()
+	names := categoryNames(catalog)
+
+	totals := map[int][]CategoryTotal{}
+	removed := map[int][]CategoryTotal{}
+	for rows.Next() {
+		var id int
+		var category sql.NullString
+		var t CategoryTotal
+		if err := rows.Scan(&id, &category, &t.Quantity, &t.FamilyNames, &t.BonusPoints, &t.Points); err != nil {
+			return nil, err
+		}
+
+		if _, ok := totals[id]; !ok {
+			totals[id] = make([]CategoryTotal, len(catalog))
+			for i, c := range catalog {
+				totals[id][i] = CategoryTotal{Category: c.Key, Name: c.Name}
+			}
+		}
+
+		// A ward with no itemized approvals has a single row with no category
+		if !category.Valid {
+			continue
+		}
+		t.Category = category.String
+		if _, ok := names[t.Category]; !ok {
+			t.Name = t.Category
+			removed[id] = append(removed[id], t)
+			continue
+		}
+		for i := range totals[id] {
+			if totals[id][i].Category == t.Category {
+				t.Name = totals[id][i].Name
+				totals[id][i] = t
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for id := range removed {
+		totals[id] = append(totals[id], removed[id]...)
+	}
+	return totals, nil
+}
+
+// findCategoryTotal returns the total for category, or a zero total if
+// there's none.
+func findCategoryTotal(totals []CategoryTotal, category string) *CategoryTotal {
+	for i := range totals {
+		if totals[i].Category == category {
+			return &totals[i]
+		}
+	}
+	return &CategoryTotal{Category: category, Name: category}
+}
+
+// categoryRanks ranks one ward against the others in each category, by
+// quantity. Wards with the same quantity share a rank.
+func categoryRanks(totals map[int][]CategoryTotal, wardID int) []CategoryRank {
+	ranks := []CategoryRank{}
+	for _, t := range totals[wardID] {
+		rank := 1
+		for id, other := range totals {
+			if id != wardID && findCategoryTotal(other, t.Category).Quantity > t.Quantity {
+				rank++
+			}
+		}
+		ranks = append(ranks, CategoryRank{CategoryTotal: t, Rank: rank})
+	}
+	return ranks
+}
+
+// See a ward's approved ordinances by category, and where it ranks in each
+func (s *Server) handleGetWardCategories(w http.ResponseWriter, r *http.Request) {
+	wardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ward ID", http.StatusBadRequest)
+		return
+	}
+
+	var wardName string
+	if err := s.db.QueryRow(`SELECT name FROM wards WHERE id = ?`, wardID).Scan(&wardName); err != nil {
+		http.Error(w, "Ward not found", http.StatusNotFound)
+		return
+	}
+
+	totals, err := s.categoryTotals(0)
+	if err != nil {
+		log.Printf("Error totaling ward categories: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ward_id":    wardID,
+		"ward_name":  wardName,
+		"wards":      len(totals),
+		"categories": categoryRanks(totals, wardID),
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestPriceItems(t *testing.T) {
+	catalog := []OrdinanceCategory{
+		{Key: "baptism", Name: "Baptisms", Points: 1},
+		{Key: "endowment", Name: "Endowments", Points: 5},
+		{Key: "sealing", Name: "Sealings", Points: 200},
+	}
+
+	tests := []struct {
+		name       string
+		multiplier float64
+		requested  []SubmissionItem
+		want       []SubmissionItem
+		total      int
+		wantErr    bool
+	}{
+		{
+			name:       "single line",
+			multiplier: 2,
+			requested:  []SubmissionItem{{Category: "endowment", Quantity: 2}},
+			want: []SubmissionItem{
+				{Category: "endowment", Name: "Endowments", Quantity: 2, PointsEach: 5, BasePoints: 10, Points: 10},
+			},
+			total: 10,
+		},
+		{
+			name:       "lines combined and in catalog order",
+			multiplier: 1,
+			requested: []SubmissionItem{
+				{Category: "endowment", Quantity: 1},
+				{Category: "baptism", Quantity: 3},
+				{Category: "endowment", Quantity: 2},
+			},
+			want: []SubmissionItem{
+				{Category: "baptism", Name: "Baptisms", Quantity: 3, PointsEach: 1, BasePoints: 3, Points: 3},
+				{Category: "endowment", Name: "Endowments", Quantity: 3, PointsEach: 5, BasePoints: 15, Points: 15},
+			},
+			total: 18,
+		},
+		{
+			name:       "submitted prices are ignored",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "baptism", Quantity: 1, PointsEach: 100, Points: 100}},
+			want: []SubmissionItem{
+				{Category: "baptism", Name: "Baptisms", Quantity: 1, PointsEach: 1, BasePoints: 1, Points: 1},
+			},
+			total: 1,
+		},
+		{
+			name:       "unknown category",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "initiatory", Quantity: 1}},
+			wantErr:    true,
+		},
+		{
+			name:       "zero quantity",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "baptism", Quantity: 0}},
+			wantErr:    true,
+		},
+		{
+			name:       "negative quantity",
+			multiplier: 1,
+			requested: []SubmissionItem{
+				{Category: "endowment", Quantity: 5},
+				{Category: "baptism", Quantity: -10},
+			},
+			wantErr: true,
+		},
+		{
+			name:       "most ordinances on a line",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "baptism", Quantity: maxItemQuantity}},
+			want: []SubmissionItem{
+				{Category: "baptism", Name: "Baptisms", Quantity: maxItemQuantity, PointsEach: 1,
+					BasePoints: maxItemQuantity, Points: maxItemQuantity},
+			},
+			total: maxItemQuantity,
+		},
+		{
+			name:       "too many ordinances on a line",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "baptism", Quantity: maxItemQuantity + 1}},
+			wantErr:    true,
+		},
+		{
+			name:       "too many ordinances once lines are combined",
+			multiplier: 1,
+			requested: []SubmissionItem{
+				{Category: "baptism", Quantity: maxItemQuantity},
+				{Category: "baptism", Quantity: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name:       "quantity that would overflow",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "endowment", Quantity: math.MaxInt/5 + 1}},
+			wantErr:    true,
+		},
+		{
+			name:       "worth too many points",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "sealing", Quantity: maxSubmissionPoints/200 + 1}},
+			wantErr:    true,
+		},
+		{
+			name:       "nothing requested",
+			multiplier: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, total, err := priceItems(catalog, tt.multiplier, tt.requested)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("priceItems = %+v, %d; want an error", items, total)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("priceItems: %v", err)
+			}
+			if total != tt.total {
+				t.Errorf("total = %d, want %d", total, tt.total)
+			}
+			if !reflect.DeepEqual(items, tt.want) {
+				t.Errorf("items = %+v, want %+v", items, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubmitTooManyOrdinances(t *testing.T) {
+	s := newTestServer(t)
+	_, pending := wardTotals(t, s, 1)
+
+	rec := newTestClient(t, s).do("POST", "/api/points", map[string]interface{}{
+		"ward_id":        1,
+		"submitter_name": "Test Member",
+		"items":          []SubmissionItem{{Category: "baptism", Quantity: 1 << 62}},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+	if _, got := wardTotals(t, s, 1); got != pending {
+		t.Errorf("pending points = %d, want %d", got, pending)
+	}
+}
+
+func TestPriceItemsFamilyNames(t *testing.T) {
+	catalog := []OrdinanceCategory{
+		{Key: "baptism", Name: "Baptisms", Points: 1},
+		{Key: "endowment", Name: "Endowments", Points: 5},
+	}
+
+	tests := []struct {
+		name       string
+		multiplier float64
+		requested  []SubmissionItem
+		want       []SubmissionItem
+		total      int
+	}{
+		{
+			name:       "family names earn the bonus",
+			multiplier: 1.5,
+			requested: []SubmissionItem{
+				{Category: "baptism", Quantity: 3, FamilyNames: true},
+				{Category: "baptism", Quantity: 2},
+			},
+			want: []SubmissionItem{
+				{Category: "baptism", Name: "Baptisms", Quantity: 2, PointsEach: 1, BasePoints: 2, Points: 2},
+				{Category: "baptism", Name: "Baptisms", Quantity: 3, FamilyNames: true, PointsEach: 1,
+					BasePoints: 3, BonusPoints: 2, Points: 5},
+			},
+			total: 7,
+		},
+		{
+			name:       "no bonus without a multiplier",
+			multiplier: 1,
+			requested:  []SubmissionItem{{Category: "endowment", Quantity: 1, FamilyNames: true}},
+			want: []SubmissionItem{
+				{Category: "endowment", Name: "Endowments", Quantity: 1, FamilyNames: true, PointsEach: 5,
+					BasePoints: 5, Points: 5},
+			},
+			total: 5,
+		},
+		{
+			name:       "largest multiplier",
+			multiplier: maxFamilyNameMultiplier,
+			requested:  []SubmissionItem{{Category: "endowment", Quantity: 2, FamilyNames: true}},
+			want: []SubmissionItem{
+				{Category: "endowment", Name: "Endowments", Quantity: 2, FamilyNames: true, PointsEach: 5,
+					BasePoints: 10, BonusPoints: 90, Points: 100},
+			},
+			total: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, total, err := priceItems(catalog, tt.multiplier, tt.requested)
+			if err != nil {
+				t.Fatalf("priceItems: %v", err)
+			}
+			if total != tt.total {
+				t.Errorf("total = %d, want %d", total, tt.total)
+			}
+			if !reflect.DeepEqual(items, tt.want) {
+				t.Errorf("items = %+v, want %+v", items, tt.want)
+			}
+		})
+	}
+}
+
+func TestFamilyNameMultiplier(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+
+	for _, m := range []float64{0.5, maxFamilyNameMultiplier + 1} {
+		rec := admin.do("POST", "/api/settings/ordinance-categories", map[string]interface{}{"family_name_multiplier": m})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("multiplier %g: status %d, want %d", m, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := admin.do("POST", "/api/settings/ordinance-categories", map[string]interface{}{"family_name_multiplier": 3})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("setting the multiplier: %d %s", rec.Code, rec.Body.String())
+	}
+
+	baptisms := func() CategoryTotal {
+		totals, err := s.categoryTotals(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *findCategoryTotal(totals[1], "baptism")
+	}
+	before := baptisms()
+
+	rec = newTestClient(t, s).do("POST", "/api/points", map[string]interface{}{
+		"ward_id":        1,
+		"submitter_name": "Test Member",
+		"items": []SubmissionItem{
+			{Category: "baptism", Quantity: 2, FamilyNames: true},
+			{Category: "baptism", Quantity: 1},
+		},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("submitting: %d %s", rec.Code, rec.Body.String())
+	}
+	var sub submitted
+	decodeJSON(t, rec, &sub)
+	if sub.Points != 7 {
+		t.Errorf("submission worth %d points, want 7", sub.Points)
+	}
+
+	if rec := admin.do("POST", pointsPath(sub.ID, "approve"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body.String())
+	}
+	after := baptisms()
+	if after.Quantity-before.Quantity != 3 || after.FamilyNames-before.FamilyNames != 2 ||
+		after.BonusPoints-before.BonusPoints != 4 || after.Points-before.Points != 7 {
+		t.Errorf("baptism totals went from %+v to %+v", before, after)
+	}
+}
+
+func TestItemizedAwardFollowsItems(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	sub := submitPoints(t, s, 1, 4)
+
+	baptisms := func() CategoryTotal {
+		totals, err := s.categoryTotals(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *findCategoryTotal(totals[1], "baptism")
+	}
+	before := baptisms()
+	points, _ := wardTotals(t, s, 1)
+
+	// Awarding less than the claim would leave the category totals counting
+	// the whole claim
+	rec := admin.do("POST", pointsPath(sub.ID, "approve"), map[string]interface{}{"points": 3, "note": "One was a duplicate"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("partial approval: status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+
+	rec = newTestClient(t, s).do("POST", receiptPath(sub.ReceiptCode), map[string]interface{}{
+		"items": []SubmissionItem{{Category: "baptism", Quantity: 3}},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("amend: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := admin.do("POST", pointsPath(sub.ID, "approve"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body.String())
+	}
+
+	after := baptisms()
+	gotPoints, _ := wardTotals(t, s, 1)
+	if after.Points-before.Points != 3 || after.Quantity-before.Quantity != 3 || gotPoints-points != 3 {
+		t.Errorf("ward gained %d points and %d baptisms worth %d; want 3 of each",
+			gotPoints-points, after.Quantity-before.Quantity, after.Points-before.Points)
+	}
+}
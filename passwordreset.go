@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL = time.Hour
+
+	// At most this many reset emails per account per hour
+	passwordResetHourlyLimit = 3
+
+	minPasswordLength = 8
+)
+
+// Email a password reset link. The response is the same whether or not the
+// email belongs to an account so it can't be used to discover users.
+func (s *Server) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.sendPasswordReset(r, strings.TrimSpace(req.Email)); err != nil {
+		log.Printf("Error requesting password reset: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "If that email has an account, a reset link is on its way.",
+	})
+}
+
+func (s *Server) sendPasswordReset(r *http.Request, email string) error {
+	base, err := s.emailLinkBaseURL()
+	if err != nil {
+		return err
+	}
+
+	var userID int
+	var disabled bool
+	err = s.db.QueryRow(`SELECT id, disabled FROM users WHERE email = ?`, email).Scan(&userID, &disabled)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if disabled {
+		log.Printf("Not sending a password reset to disabled user %d", userID)
+		return nil
+	}
+
+	var recent int
+	err = s.db.QueryRow(`
+		SELECT COUNT(*) FROM password_resets
+		WHERE user_id = ? AND created_at > datetime('now', '-1 hour')
+	`, userID).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent >= passwordResetHourlyLimit {
+		log.Printf("Password reset limit reached for user %d", userID)
+		return nil
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the newest link works
+	_, err = s.db.Exec(`
+		UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO password_resets (user_id, token_hash, ip_address, expires_at)
+		VALUES (?, ?, ?, datetime('now', ?))
+	`, userID, hashToken(token), clientIP(r),
+		fmt.Sprintf("+%d seconds", int(passwordResetTTL.Seconds())))
+	if err != nil {
+		return err
+	}
+
+	link := base + "/reset-password?token=" + url.QueryEscape(token)
+	s.sendMail(email, "Reset your Temple Points password", fmt.Sprintf(
+		"Someone asked to reset the password for your Temple Points account.\n\n"+
+			"To choose a new password, open this link within %d minutes:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n",
+		int(passwordResetTTL.Minutes()), link))
+
+	s.logActivity(s.logWardForUser(userID), &userID, "password_reset_requested",
+		fmt.Sprintf("Password reset requested for %s from %s", email, clientIP(r)), 0)
+
+	return nil
+}
+
+// Set a new password using an emailed reset token
+func (s *Server) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength),
+			http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var resetID, userID int
+	var email string
+	var disabled bool
+	err = tx.QueryRow(`
+		SELECT r.id, r.user_id, u.email, u.disabled
+		FROM password_resets r
+		JOIN users u ON r.user_id = u.id
+		WHERE r.token_hash = ? AND r.used_at IS NULL AND r.expires_at > CURRENT_TIMESTAMP
+	`, hashToken(req.Token)).Scan(&resetID, &userID, &email, &disabled)
+	if err != nil {
+		http.Error(w, "This reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	if disabled {
+		tx.Rollback()
+		s.logActivity(s.logWardForUser(userID), &userID, "password_reset_refused",
+			fmt.Sprintf("Refused a password reset for disabled account %s from %s", email, clientIP(r)), 0)
+		http.Error(w, "This account has been disabled", http.StatusForbidden)
+		return
+	}
+
+	// Claim the token; if another request got there first, stop
+	result, err := tx.Exec(`
+		UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL
+	`, resetID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		http.Error(w, "This reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	// Only hash once the token is known to be good, so bogus tokens cost
+	// nothing. If this fails the claim is rolled back with everything else.
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error processing password", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, string(hashedPassword), userID); err != nil {
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	// Anyone signed in with the old password is signed out, and any API
+	// token they may have created stops working
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := revokeUserAPITokens(tx, userID); err != nil {
+		log.Printf("Error revoking API tokens: %v", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	// The owner has proven control of the mailbox, so lift any lockout
+	if err := s.clearLoginFailures(emailThrottleKey(email)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	s.logActivity(s.logWardForUser(userID), &userID, "password_reset",
+		fmt.Sprintf("Password reset for %s from %s", email, clientIP(r)), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Password updated. You can sign in now.",
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requestPasswordReset asks for a reset link for email and returns the token
+// from the email the fake SMTP server receives.
+func requestPasswordReset(t *testing.T, s *Server, received <-chan fakeMail, email string) string {
+	t.Helper()
+
+	rec := newTestClient(t, s).do("POST", "/api/password-reset/request", map[string]string{"email": email})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("requesting reset: %d %s", rec.Code, rec.Body.String())
+	}
+
+	link, err := url.Parse(readMailLine(t, waitForMail(t, received), "/reset-password?token="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link.String(), s.config.BaseURL+"/") {
+		t.Errorf("link %s isn't on BASE_URL", link)
+	}
+	return link.Query().Get("token")
+}
+
+func confirmPasswordReset(c *testClient, token, password string) int {
+	return c.do("POST", "/api/password-reset/confirm", map[string]string{"token": token, "password": password}).Code
+}
+
+func TestPasswordResetTokens(t *testing.T) {
+	s, received := newMailingServer(t)
+	createTestUser(t, s, "member@example.org", "clerk", 1)
+
+	tests := []struct {
+		name   string
+		token  func(t *testing.T) string
+		want   int
+		reused bool // try the token a second time
+	}{
+		{"valid token", func(t *testing.T) string {
+			return requestPasswordReset(t, s, received, "member@example.org")
+		}, http.StatusOK, true},
+		{"expired token", func(t *testing.T) string {
+			token := requestPasswordReset(t, s, received, "member@example.org")
+			s.db.Exec(`UPDATE password_resets SET expires_at = datetime('now', '-1 minute') WHERE token_hash = ?`,
+				hashToken(token))
+			return token
+		}, http.StatusBadRequest, false},
+		{"superseded token", func(t *testing.T) string {
+			token := requestPasswordReset(t, s, received, "member@example.org")
+			requestPasswordReset(t, s, received, "member@example.org")
+			return token
+		}, http.StatusBadRequest, false},
+		{"unknown token", func(*testing.T) string { return "not-a-real-token" }, http.StatusBadRequest, false},
+		{"empty token", func(*testing.T) string { return "" }, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stay under the hourly limit on reset emails
+			s.db.Exec(`DELETE FROM password_resets`)
+
+			c := newTestClient(t, s)
+			token := tt.token(t)
+			if code := confirmPasswordReset(c, token, "a new password"); code != tt.want {
+				t.Fatalf("confirm: status %d, want %d", code, tt.want)
+			}
+			if tt.reused {
+				if code := confirmPasswordReset(c, token, "another password"); code != http.StatusBadRequest {
+					t.Errorf("second use: status %d, want %d", code, http.StatusBadRequest)
+				}
+			}
+		})
+	}
+
+	newTestClient(t, s).login("member@example.org", "a new password")
+}
+
+func TestPasswordResetRevokesSessionsAndTokens(t *testing.T) {
+	s, received := newMailingServer(t)
+	createTestUser(t, s, "member@example.org", "clerk", 1)
+
+	browser := newTestClient(t, s)
+	browser.login("member@example.org", testPassword)
+	rec := browser.do("POST", "/api/tokens", map[string]interface{}{
+		"name": "script", "scopes": []string{permViewSubmissions},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("creating token: %d %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, rec, &created)
+	script := newTestClient(t, s)
+	script.headers["Authorization"] = "Bearer " + created.Token
+
+	token := requestPasswordReset(t, s, received, "member@example.org")
+	if code := confirmPasswordReset(newTestClient(t, s), token, "a new password"); code != http.StatusOK {
+		t.Fatalf("confirm: status %d", code)
+	}
+
+	if rec := browser.do("GET", "/api/user", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session after reset: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := script.do("GET", "/api/submissions", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("API token after reset: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = newTestClient(t, s).do("POST", "/api/login",
+		map[string]string{"email": "member@example.org", "password": testPassword})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("old password after reset: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPasswordResetOfDisabledAccount(t *testing.T) {
+	s, received := newMailingServer(t)
+	userID := createTestUser(t, s, "member@example.org", "clerk", 1)
+
+	token := requestPasswordReset(t, s, received, "member@example.org")
+	if _, err := s.db.Exec(`UPDATE users SET disabled = 1 WHERE id = ?`, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := confirmPasswordReset(newTestClient(t, s), token, "a new password"); code != http.StatusForbidden {
+		t.Errorf("confirm for a disabled account: status %d, want %d", code, http.StatusForbidden)
+	}
+
+	var refused int
+	s.db.QueryRow(`SELECT COUNT(*) FROM activity_logs WHERE action = 'password_reset_refused'`).Scan(&refused)
+	if refused != 1 {
+		t.Errorf("%d password_reset_refused log entries, want 1", refused)
+	}
+
+	// No new link is sent while the account is disabled
+	newTestClient(t, s).do("POST", "/api/password-reset/request", map[string]string{"email": "member@example.org"})
+	select {
+	case msg := <-received:
+		t.Errorf("a reset email was sent to a disabled account: %q", msg.Data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPasswordResetRequest(t *testing.T) {
+	s, received := newMailingServer(t)
+	c := newTestClient(t, s)
+
+	// Unknown emails get the same answer and no email
+	rec := c.do("POST", "/api/password-reset/request", map[string]string{"email": "nobody@example.org"})
+	if rec.Code != http.StatusOK {
+		t.Errorf("unknown email: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// Without BASE_URL no link is emailed at all
+	s.config.BaseURL = ""
+	c.do("POST", "/api/password-reset/request", map[string]string{"email": "admin@templepoints.org"})
+
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected email: %q", msg.Data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if code := confirmPasswordReset(c, "whatever", "short"); code != http.StatusBadRequest {
+		t.Errorf("short password: status %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Named permissions. Handlers check these rather than role names so a new
+// role only needs an entry in roleDefinitions.
+const (
+	permReadLeaderboard    = "leaderboard:read"
+	permViewSubmissions    = "submissions:read"
+	permApproveSubmissions = "submissions:approve"
+	permCreateSubmissions  = "submissions:create"
+	permManageUsers        = "users:manage"
+)
+
+type roleDefinition struct {
+	Label string
+
+	// StakeWide roles hold their permissions for every ward. Other roles only
+	// hold them for the wards they're a member of in user_wards.
+	StakeWide   bool
+	Permissions []string
+}
+
+var roleDefinitions = map[string]roleDefinition{
+	"admin": {
+		Label:     "Administrator",
+		StakeWide: true,
+		Permissions: []string{
+			permReadLeaderboard, permViewSubmissions, permApproveSubmissions, permCreateSubmissions,
+			permManageUsers,
+		},
+	},
+	"stake_viewer": {
+		Label:       "Stake Viewer",
+		StakeWide:   true,
+		Permissions: []string{permReadLeaderboard, permViewSubmissions},
+	},
+	"clerk": {
+		Label:       "Clerk",
+		Permissions: []string{permReadLeaderboard, permViewSubmissions, permCreateSubmissions},
+	},
+	"ward_approver": {
+		Label:       "Ward Approver",
+		Permissions: []string{permReadLeaderboard, permViewSubmissions, permApproveSubmissions},
+	},
+}
+
+func roleHasPermission(role, permission string) bool {
+	for _, p := range roleDefinitions[role].Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// permittedWards returns the wards in which the user holds permission. all is
+// true when it applies to every ward; otherwise wardIDs lists them (and may
+// be empty).
+func (s *Server) permittedWards(userID int, permission string) (all bool, wardIDs []int, err error) {
+	var role string
+	var disabled bool
+	err = s.db.QueryRow(`SELECT role, disabled FROM users WHERE id = ?`, userID).Scan(&role, &disabled)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if disabled || !roleHasPermission(role, permission) {
+		return false, nil, nil
+	}
+
+	if roleDefinitions[role].StakeWide {
+		return true, nil, nil
+	}
+
+	wardIDs, err = s.userWardIDs(userID)
+	return false, wardIDs, err
+}
+
+// hasPermission reports whether the user holds permission for wardID. Pass a
+// wardID of 0 for permissions that aren't about a particular ward.
+func (s *Server) hasPermission(userID int, permission string, wardID int) bool {
+	all, wardIDs, err := s.permittedWards(userID, permission)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error checking permission %s: %v", permission, err)
+		}
+		return false
+	}
+
+	if all {
+		return true
+	}
+
+	for _, id := range wardIDs {
+		if id == wardID {
+			return true
+		}
+	}
+	return false
+}
+
+// userPermissions lists every permission the user's role grants, for the UI.
+func userPermissions(role string) []string {
+	return append([]string{}, roleDefinitions[role].Permissions...)
+}
+
+func (s *Server) userWardIDs(userID int) ([]int, error) {
+	rows, err := s.db.Query(`SELECT ward_id FROM user_wards WHERE user_id = ? ORDER BY ward_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wardIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		wardIDs = append(wardIDs, id)
+	}
+	return wardIDs, rows.Err()
+}
+
+// logWard picks the ward an event about an account or invitation covering
+// wardIDs is logged against: the ward if there's exactly one, otherwise 0
+// (stake-wide).
+func logWard(wardIDs []int) int {
+	if len(wardIDs) != 1 {
+		return 0
+	}
+	return wardIDs[0]
+}
+
+// logWardForUser is logWard for the user's current wards.
+func (s *Server) logWardForUser(userID int) int {
+	wardIDs, err := s.userWardIDs(userID)
+	if err != nil {
+		return 0
+	}
+	return logWard(wardIDs)
+}
+
+// wardRefIDs returns the IDs of wards.
+func wardRefIDs(wards []WardRef) []int {
+	ids := make([]int, len(wards))
+	for i, ward := range wards {
+		ids[i] = ward.ID
+	}
+	return ids
+}
+
+// setUserWards replaces the user's ward memberships inside tx.
+func setUserWards(tx *sql.Tx, userID int, wardIDs []int) error {
+	if _, err := tx.Exec(`DELETE FROM user_wards WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	for _, wardID := range wardIDs {
+		if _, err := tx.Exec(`INSERT INTO user_wards (user_id, ward_id) VALUES (?, ?)`, userID, wardID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRoleAssignment checks a role and wards for a new or updated user.
+// It returns the wards to store (none for stake-wide roles, which cover every
+// ward) or a message describing the problem.
+func validateRoleAssignment(role string, wardIDs []int) ([]int, string) {
+	definition, ok := roleDefinitions[role]
+	if !ok {
+		return nil, "Invalid role - must be one of " + strings.Join(userRoles, ", ")
+	}
+
+	if definition.StakeWide {
+		return nil, ""
+	}
+
+	seen := make(map[int]bool)
+	var wards []int
+	for _, wardID := range wardIDs {
+		if wardID <= 0 {
+			return nil, "Invalid ward"
+		}
+		if !seen[wardID] {
+			seen[wardID] = true
+			wards = append(wards, wardID)
+		}
+	}
+
+	if len(wards) == 0 {
+		return nil, fmt.Sprintf("At least one ward is required for %ss", strings.ToLower(definition.Label))
+	}
+
+	return wards, ""
+}
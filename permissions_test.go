@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestHasPermission(t *testing.T) {
+	s := newTestServer(t)
+	viewer := createTestUser(t, s, "viewer@example.org", "stake_viewer")
+	clerk := createTestUser(t, s, "clerk@example.org", "clerk", 1)
+	approver := createTestUser(t, s, "approver@example.org", "ward_approver", 1, 2)
+	disabled := createTestUser(t, s, "disabled@example.org", "ward_approver", 1)
+	s.db.Exec(`UPDATE users SET disabled = 1 WHERE id = ?`, disabled)
+
+	tests := []struct {
+		name       string
+		userID     int
+		permission string
+		wardID     int
+		want       bool
+	}{
+		{"admin approves anywhere", 1, permApproveSubmissions, 5, true},
+		{"admin manages users", 1, permManageUsers, 0, true},
+		{"stake viewer views any ward", viewer, permViewSubmissions, 7, true},
+		{"stake viewer can't approve", viewer, permApproveSubmissions, 1, false},
+		{"clerk submits for their ward", clerk, permCreateSubmissions, 1, true},
+		{"clerk can't submit for another ward", clerk, permCreateSubmissions, 2, false},
+		{"clerk can't approve", clerk, permApproveSubmissions, 1, false},
+		{"approver approves in their first ward", approver, permApproveSubmissions, 1, true},
+		{"approver approves in their second ward", approver, permApproveSubmissions, 2, true},
+		{"approver can't approve elsewhere", approver, permApproveSubmissions, 3, false},
+		{"approver can't manage users", approver, permManageUsers, 0, false},
+		{"disabled approver", disabled, permApproveSubmissions, 1, false},
+		{"unknown user", 999, permReadLeaderboard, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.hasPermission(tt.userID, tt.permission, tt.wardID); got != tt.want {
+				t.Errorf("hasPermission(%d, %s, %d) = %v, want %v", tt.userID, tt.permission, tt.wardID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvitationLogWard(t *testing.T) {
+	tests := []struct {
+		name    string
+		wardIDs []int
+		want    int
+	}{
+		{"one ward", []int{3}, 3},
+		{"several wards", []int{1, 2}, 0},
+		{"stake-wide role", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, received := newMailingServer(t)
+			admin := newTestClient(t, s)
+			admin.login("admin@templepoints.org", "admin123")
+
+			role := "ward_approver"
+			if tt.wardIDs == nil {
+				role = "stake_viewer"
+			}
+			token := invite(t, admin, received, map[string]interface{}{
+				"email": "invitee@example.org", "role": role, "ward_ids": tt.wardIDs,
+			})
+			rec := newTestClient(t, s).do("POST", "/api/invitations/accept",
+				map[string]string{"token": token, "password": testPassword})
+			if rec.Code != 200 {
+				t.Fatalf("accepting: %d %s", rec.Code, rec.Body.String())
+			}
+
+			for _, action := range []string{"user_invited", "invitation_accepted"} {
+				var wardID sql.NullInt64
+				if err := s.db.QueryRow(`SELECT ward_id FROM activity_logs WHERE action = ?`, action).Scan(&wardID); err != nil {
+					t.Fatalf("%s: %v", action, err)
+				}
+				if int(wardID.Int64) != tt.want {
+					t.Errorf("%s logged under ward %d, want %d", action, wardID.Int64, tt.want)
+				}
+			}
+
+			var userWards int
+			s.db.QueryRow(`SELECT COUNT(*) FROM user_wards uw JOIN users u ON uw.user_id = u.id
+				WHERE u.email = 'invitee@example.org'`).Scan(&userWards)
+			if userWards != len(tt.wardIDs) {
+				t.Errorf("invitee has %d wards, want %d", userWards, len(tt.wardIDs))
+			}
+		})
+	}
+}
+
+func TestMigrateSingleWardInvitations(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "old.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Invitations as they were before invitation_wards
+	_, err = db.Exec(`
+		CREATE TABLE wards (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			points INTEGER DEFAULT 0,
+			pending_points INTEGER DEFAULT 0
+		);
+		INSERT INTO wards (name) VALUES ('First'), ('Second');
+		CREATE TABLE invitations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT NOT NULL,
+			role TEXT NOT NULL,
+			ward_id INTEGER,
+			token_hash TEXT NOT NULL UNIQUE,
+			invited_by INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			accepted_at DATETIME,
+			revoked_at DATETIME,
+			FOREIGN KEY (ward_id) REFERENCES wards(id)
+		);
+		INSERT INTO invitations (email, role, ward_id, token_hash, expires_at)
+		VALUES ('a@example.org', 'ward_approver', 2, 'a', CURRENT_TIMESTAMP),
+		       ('b@example.org', 'admin', NULL, 'b', CURRENT_TIMESTAMP);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createTables(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	wards, err := invitationWards(db, 1)
+	if err != nil || len(wards) != 1 || wards[0].ID != 2 {
+		t.Errorf("migrated wards = %+v, %v; want ward 2", wards, err)
+	}
+	if wards, _ := invitationWards(db, 2); len(wards) != 0 {
+		t.Errorf("invitation without a ward got %+v", wards)
+	}
+
+	// Fresh databases don't have the old column at all
+	fresh := newTestServer(t)
+	if exists, _, err := lookupColumn(fresh.db, "invitations", "ward_id"); err != nil || exists {
+		t.Errorf("fresh invitations table has ward_id: %v, %v", exists, err)
+	}
+}
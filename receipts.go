@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Submissions are anonymous, so the receipt code handed out when points are
+// submitted is what lets the submitter come back to check on them, and to
+// amend or withdraw them while they're still pending.
+
+// receiptSubmission finds the submission for the receipt code in the URL,
+// writing a 404 and returning nil if there isn't one.
+func (s *Server) receiptSubmission(w http.ResponseWriter, r *http.Request) *PointSubmission {
+	var sub PointSubmission
+	err := s.db.QueryRow(`
+		SELECT p.id, p.ward_id, w.name, p.submitter_name, p.points, p.awarded_points,
+		       COALESCE(p.approval_note, ''), COALESCE(p.rejection_reason, ''), COALESCE(p.note, ''),
+		       p.status, p.created_at, p.reversed_at, COALESCE(p.reversal_reason, ''),
+		       COALESCE(p.activity_date, ''), p.version
+		FROM point_submissions p
+		JOIN wards w ON p.ward_id = w.id
+		WHERE p.edit_token_hash = ?
+	`, hashToken(mux.Vars(r)["code"])).Scan(&sub.ID, &sub.WardID, &sub.WardName, &sub.SubmitterName,
+		&sub.Points, &sub.AwardedPoints, &sub.ApprovalNote, &sub.RejectionReason, &sub.Note,
+		&sub.Status, &sub.CreatedAt, &sub.ReversedAt, &sub.ReversalReason, &sub.ActivityDate, &sub.Version)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Receipt not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error looking up receipt: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return nil
+	}
+
+	items, err := s.submissionItems([]int{sub.ID})
+	if err != nil {
+		log.Printf("Error loading submission items: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil
+	}
+	sub.Items = items[sub.ID]
+
+	return &sub
+}
+
+func submissionEdits(q rowQuerier, submissionID int) ([]SubmissionEdit, error) {
+	rows, err := q.Query(`
+		SELECT id, action, old_points, new_points, COALESCE(old_note, ''), COALESCE(new_note, ''),
+		       old_items, new_items, created_at
+		FROM submission_edits
+		WHERE submission_id = ?
+		ORDER BY id
+	`, submissionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []SubmissionEdit{}
+	for rows.Next() {
+		var e SubmissionEdit
+		var oldItems, newItems sql.NullString
+		err := rows.Scan(&e.ID, &e.Action, &e.OldPoints, &e.NewPoints, &e.OldNote, &e.NewNote,
+			&oldItems, &newItems, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if e.OldItems, err = unmarshalItems(oldItems); err != nil {
+			return nil, err
+		}
+		if e.NewItems, err = unmarshalItems(newItems); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// marshalItems encodes line items for submission_edits, as NULL if there
+// aren't any.
+func marshalItems(items []SubmissionItem) (sql.NullString, error) {
+	if len(items) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalItems(data sql.NullString) ([]SubmissionItem, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var items []SubmissionItem
+	err := json.Unmarshal([]byte(data.String), &items)
+	return items, err
+}
+
+// Check on a submission by its receipt code
+func (s *Server) handleGetReceipt(w http.ResponseWriter, r *http.Request) {
+	sub := s.receiptSubmission(w, r)
+	if sub == nil {
+		return
+	}
+
+	edits, err := submissionEdits(s.db, sub.ID)
+	if err != nil {
+		log.Printf("Error loading submission edits: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	comments, err := submissionComments(s.db, sub.ID)
+	if err != nil {
+		log.Printf("Error loading submission comments: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"submission": sub,
+		"editable":   sub.undecided(),
+		"edits":      edits,
+		"comments":   comments,
+	})
+}
+
+// Change the points, items or note on a pending submission by its receipt
+// code. Points can only change through items unless an admin allows
+// un-itemized submissions.
+func (s *Server) handleAmendReceipt(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Points int              `json:"points"`
+		Note   *string          `json:"note"`
+		Items  []SubmissionItem `json:"items"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	sub := s.receiptSubmission(w, r)
+	if sub == nil {
+		return
+	}
+
+	points := req.Points
+	var items []SubmissionItem
+	switch {
+	case len(req.Items) > 0:
+		var err error
+		items, points, err = priceItems(s.ordinanceCategories(), s.familyNameMultiplier(), req.Items)
+		if err != nil {
+			http.Error(w, "Invalid items: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case len(sub.Items) > 0:
+		if points != 0 && points != sub.Points {
+			http.Error(w, "This submission is itemized; change its items instead", http.StatusBadRequest)
+			return
+		}
+		points = sub.Points
+	case !s.unitemizedAllowed():
+		// Un-itemized submissions made while they were allowed can still
+		// have their note changed, or be itemized
+		if points != 0 && points != sub.Points {
+			http.Error(w, "List the ordinances completed to change the points", http.StatusBadRequest)
+			return
+		}
+		points = sub.Points
+	case points <= 0:
+		http.Error(w, "Points must be positive", http.StatusBadRequest)
+		return
+	case points > maxSubmissionPoints:
+		http.Error(w, fmt.Sprintf("A submission can be worth at most %d points", maxSubmissionPoints), http.StatusBadRequest)
+		return
+	}
+
+	note := sub.Note
+	if req.Note != nil {
+		note = strings.TrimSpace(*req.Note)
+	}
+
+	if points == sub.Points && note == sub.Note && (items == nil || sameItems(items, sub.Items)) {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = recordSubmissionEdit(tx, r, sub, ledgerAmended, points, note, items)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == errSubmissionNotPending {
+		http.Error(w, "This submission is no longer pending and can't be changed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error amending submission %d: %v", sub.ID, err)
+		http.Error(w, "Failed to update submission", http.StatusInternalServerError)
+		return
+	}
+
+	details := fmt.Sprintf("%s changed their submission", sub.SubmitterName)
+	if points != sub.Points {
+		details = fmt.Sprintf("%s changed their submission from %d to %d points",
+			sub.SubmitterName, sub.Points, points)
+	}
+	s.logActivity(sub.WardID, nil, "submission_amended", details, points-sub.Points)
+
+	s.broadcastLeaderboardUpdate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Your submission has been updated",
+	})
+}
+
+// Withdraw a pending submission by its receipt code
+func (s *Server) handleWithdrawReceipt(w http.ResponseWriter, r *http.Request) {
+	sub := s.receiptSubmission(w, r)
+	if sub == nil {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = recordSubmissionEdit(tx, r, sub, ledgerWithdrawn, sub.Points, sub.Note, nil)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == errSubmissionNotPending {
+		http.Error(w, "This submission is no longer pending and can't be withdrawn", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error withdrawing submission %d: %v", sub.ID, err)
+		http.Error(w, "Failed to withdraw submission", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(sub.WardID, nil, "submission_withdrawn",
+		fmt.Sprintf("%s withdrew their submission of %d points", sub.SubmitterName, sub.Points), -sub.Points)
+
+	s.broadcastLeaderboardUpdate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Your submission has been withdrawn",
+	})
+}
+
+// recordSubmissionEdit applies a submitter's change inside tx: action is
+// ledgerAmended (new points and note, and new items unless nil) or
+// ledgerWithdrawn. The change, including the items before and after, is kept
+// in submission_edits, and any change to the claim is recorded in the ledger
+// so the ward's pending total follows it. It returns errSubmissionNotPending
+// if the submission was decided or changed since sub was loaded.
+func recordSubmissionEdit(tx *sql.Tx, r *http.Request, sub *PointSubmission, action string, points int, note string,
+	items []SubmissionItem) error {
+	// Amending answers any question an approver asked, so it's back for review
+	status := "pending"
+	pendingDelta := points - sub.Points
+	if action == ledgerWithdrawn {
+		status = "withdrawn"
+		pendingDelta = -sub.Points
+	}
+
+	result, err := tx.Exec(`
+		UPDATE point_submissions SET status = ?, points = ?, note = ?, version = version + 1
+		WHERE id = ? AND status IN ('pending', 'needs_info') AND version = ?
+	`, status, points, note, sub.ID, sub.Version)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return errSubmissionNotPending
+	}
+
+	if items != nil {
+		if err := replaceSubmissionItems(tx, sub.ID, items); err != nil {
+			return err
+		}
+	}
+
+	newItems := sub.Items
+	if items != nil {
+		newItems = items
+	}
+	oldItemsJSON, err := marshalItems(sub.Items)
+	if err != nil {
+		return err
+	}
+	newItemsJSON, err := marshalItems(newItems)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO submission_edits (submission_id, action, old_points, new_points, old_note, new_note,
+		                              old_items, new_items, ip_address)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, sub.ID, action, sub.Points, points, sub.Note, note, oldItemsJSON, newItemsJSON, clientIP(r))
+	if err != nil {
+		return err
+	}
+
+	if pendingDelta == 0 {
+		return nil
+	}
+
+	entryNote := fmt.Sprintf("Changed by the submitter from %d to %d points", sub.Points, points)
+	if action == ledgerWithdrawn {
+		entryNote = "Withdrawn by the submitter"
+	}
+	return recordLedgerEntry(tx, LedgerEntry{
+		WardID:       sub.WardID,
+		SubmissionID: &sub.ID,
+		EntryType:    action,
+		PendingDelta: pendingDelta,
+		Note:         entryNote,
+	})
+}
+
+// See what a submitter changed on a submission before it was reviewed
+func (s *Server) handleGetSubmissionEdits(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	submissionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+
+	submission := s.loadSubmission(w, submissionID)
+	if submission == nil {
+		return
+	}
+
+	if !s.hasPermission(userID, permViewSubmissions, submission.WardID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	edits, err := submissionEdits(s.db, submission.ID)
+	if err != nil {
+		log.Printf("Error loading submission edits: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"edits": edits,
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func receiptPath(code string) string {
+	return "/api/receipts/" + code
+}
+
+func TestAmendReceiptKeepsItemHistory(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	submitter := newTestClient(t, s)
+	sub := submitPoints(t, s, 1, 2)
+	_, pending := wardTotals(t, s, 1)
+
+	// Same total, different ordinances
+	rec := submitter.do("POST", receiptPath(sub.ReceiptCode), map[string]interface{}{
+		"items": []SubmissionItem{{Category: "initiatory", Quantity: 2}},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("amend: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, got := wardTotals(t, s, 1); got != pending {
+		t.Errorf("pending points = %d, want %d", got, pending)
+	}
+
+	rec = admin.do("GET", pointsPath(sub.ID, "edits"), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("edits: %d %s", rec.Code, rec.Body.String())
+	}
+	var history struct {
+		Edits []SubmissionEdit `json:"edits"`
+	}
+	decodeJSON(t, rec, &history)
+	if len(history.Edits) != 1 {
+		t.Fatalf("%d edits, want 1", len(history.Edits))
+	}
+	edit := history.Edits[0]
+	if edit.OldPoints != 2 || edit.NewPoints != 2 {
+		t.Errorf("points %d → %d, want 2 → 2", edit.OldPoints, edit.NewPoints)
+	}
+	if len(edit.OldItems) != 1 || edit.OldItems[0].Category != "baptism" || edit.OldItems[0].Quantity != 2 {
+		t.Errorf("old items = %+v, want 2 baptisms", edit.OldItems)
+	}
+	if len(edit.NewItems) != 1 || edit.NewItems[0].Category != "initiatory" || edit.NewItems[0].Quantity != 2 {
+		t.Errorf("new items = %+v, want 2 initiatory", edit.NewItems)
+	}
+
+	// Approving what was reviewed before the swap is refused
+	if rec := admin.do("POST", pointsPath(sub.ID, "approve"), map[string]interface{}{"version": 1}); rec.Code != http.StatusConflict {
+		t.Errorf("approving the old version: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if rec := admin.do("POST", pointsPath(sub.ID, "approve"), map[string]interface{}{"version": 2}); rec.Code != http.StatusOK {
+		t.Fatalf("approving the new version: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = submitter.do("POST", receiptPath(sub.ReceiptCode), map[string]interface{}{
+		"items": []SubmissionItem{{Category: "sealing", Quantity: 2}},
+	})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("amending after approval: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestWithdrawReceipt(t *testing.T) {
+	s := newTestServer(t)
+	submitter := newTestClient(t, s)
+	sub := submitPoints(t, s, 1, 3)
+	_, pending := wardTotals(t, s, 1)
+
+	if rec := submitter.do("POST", receiptPath(sub.ReceiptCode)+"/withdraw", nil); rec.Code != http.StatusOK {
+		t.Fatalf("withdraw: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, got := wardTotals(t, s, 1); got != pending-sub.Points {
+		t.Errorf("pending points = %d, want %d", got, pending-sub.Points)
+	}
+	if rec := submitter.do("POST", receiptPath(sub.ReceiptCode)+"/withdraw", nil); rec.Code != http.StatusConflict {
+		t.Errorf("withdrawn twice: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	rec := submitter.do("GET", receiptPath(sub.ReceiptCode), nil)
+	var receipt struct {
+		Submission PointSubmission  `json:"submission"`
+		Editable   bool             `json:"editable"`
+		Edits      []SubmissionEdit `json:"edits"`
+	}
+	decodeJSON(t, rec, &receipt)
+	if receipt.Submission.Status != "withdrawn" || receipt.Editable {
+		t.Errorf("receipt shows %s, editable %v", receipt.Submission.Status, receipt.Editable)
+	}
+	if len(receipt.Edits) != 1 || receipt.Edits[0].Action != "withdrawn" || len(receipt.Edits[0].OldItems) != 1 {
+		t.Errorf("edits = %+v", receipt.Edits)
+	}
+
+	if rec := submitter.do("GET", receiptPath("not-a-receipt"), nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown receipt: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
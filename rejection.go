@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const rejectionReasonsSetting = "rejection_reasons"
+
+// defaultRejectionReasons are offered until an admin sets their own list.
+var defaultRejectionReasons = []string{
+	"Duplicate of another submission",
+	"Points don't match the activity described",
+	"Not a temple or family history activity",
+	"Submitted for the wrong ward",
+}
+
+// rejectionReasons returns the canned reasons approvers can pick from when
+// rejecting. They can always write their own instead.
+func (s *Server) rejectionReasons() []string {
+	value, err := getSetting(s.db, rejectionReasonsSetting)
+	if err != nil {
+		return defaultRejectionReasons
+	}
+
+	var reasons []string
+	if err := json.Unmarshal([]byte(value), &reasons); err != nil {
+		log.Printf("Error reading rejection reasons: %v", err)
+		return defaultRejectionReasons
+	}
+	return reasons
+}
+
+// View the canned rejection reasons (approvers), or replace them (admin only)
+func (s *Server) handleRejectionReasons(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !s.isAdmin(userID) {
+			http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Reasons []string `json:"reasons"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		reasons := []string{}
+		for _, reason := range req.Reasons {
+			if reason = strings.TrimSpace(reason); reason != "" {
+				reasons = append(reasons, reason)
+			}
+		}
+
+		value, _ := json.Marshal(reasons)
+		if err := setSetting(s.db, rejectionReasonsSetting, string(value)); err != nil {
+			log.Printf("Error saving rejection reasons: %v", err)
+			http.Error(w, "Failed to save rejection reasons", http.StatusInternalServerError)
+			return
+		}
+
+		s.logActivity(0, &userID, "rejection_reasons_changed",
+			fmt.Sprintf("Rejection reasons set to: %s", strings.Join(reasons, "; ")), 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reasons": s.rejectionReasons(),
+	})
+}
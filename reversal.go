@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// errSubmissionNotApproved means the approval was reversed by someone else
+// first.
+var errSubmissionNotApproved = errors.New("submission is no longer approved")
+
+// Undo an approval. The points come off the ward's verified total and the
+// submission goes back to pending for another look, or is rejected outright.
+func (s *Server) handleReversePoints(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	submissionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Status != "pending" && req.Status != "rejected" {
+		http.Error(w, `Status must be "pending" or "rejected"`, http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	submission := s.loadSubmission(w, submissionID)
+	if submission == nil {
+		return
+	}
+
+	if !s.canApproveForWard(userID, submission.WardID) {
+		http.Error(w, "Not authorized to approve for this ward", http.StatusForbidden)
+		return
+	}
+
+	if submission.Status != "approved" {
+		http.Error(w, fmt.Sprintf("Only approved submissions can be reversed; this one is %s", submission.Status),
+			http.StatusConflict)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := reverseSubmission(tx, submission, userID, req.Status, req.Reason); err != nil {
+		if err == errSubmissionNotApproved {
+			http.Error(w, "Submission was already reversed by someone else", http.StatusConflict)
+		} else {
+			log.Printf("Error reversing submission %d: %v", submission.ID, err)
+			http.Error(w, "Failed to reverse approval", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reverse approval", http.StatusInternalServerError)
+		return
+	}
+
+	revoked := s.revokeLostAchievements(submission.WardID)
+
+	s.logActivity(submission.WardID, &userID, "points_reversed",
+		fmt.Sprintf("Reversed approval of %d points from %s (now %s): %s",
+			submission.awarded(), submission.SubmitterName, req.Status, req.Reason),
+		-submission.awarded())
+
+	for _, title := range revoked {
+		s.logActivity(submission.WardID, &userID, "achievement_revoked",
+			fmt.Sprintf("Revoked %q after an approval was reversed", title), 0)
+	}
+
+	s.broadcastLeaderboardUpdate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":              true,
+		"message":              fmt.Sprintf("Approval reversed; submission is now %s", req.Status),
+		"revoked_achievements": revoked,
+	})
+}
+
+// reverseSubmission moves an approved submission to status ("pending" or
+// "rejected") inside tx and records in the ledger that its awarded points
+// leave the ward's verified total, with the claim returning to pending if
+// it's up for review again. Like decideSubmission, only one of two
+// simultaneous reversals succeeds.
+func reverseSubmission(tx *sql.Tx, submission *PointSubmission, userID int, status, reason string) error {
+	// A rejection is a decision by the reverser; pending has no decision yet
+	var decidedBy *int
+	if status == "rejected" {
+		decidedBy = &userID
+	}
+
+	result, err := tx.Exec(`
+		UPDATE point_submissions
+		SET status = ?,
+		    approved_by = ?,
+		    approved_at = CASE WHEN ? IS NULL THEN NULL ELSE CURRENT_TIMESTAMP END,
+		    awarded_points = NULL,
+		    approval_note = NULL,
+		    reversed_by = ?,
+		    reversed_at = CURRENT_TIMESTAMP,
+		    reversal_reason = ?,
+		    version = version + 1
+		WHERE id = ? AND status = 'approved'
+	`, status, decidedBy, decidedBy, userID, reason, submission.ID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return errSubmissionNotApproved
+	}
+
+	entry := LedgerEntry{
+		WardID:        submission.WardID,
+		SubmissionID:  &submission.ID,
+		EntryType:     ledgerReversed,
+		VerifiedDelta: -submission.awarded(),
+		UserID:        &userID,
+		Note:          reason,
+	}
+	if status == "pending" {
+		entry.PendingDelta = submission.Points
+	}
+	return recordLedgerEntry(tx, entry)
+}
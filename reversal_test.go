@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReverseApproval(t *testing.T) {
+	for _, status := range []string{"pending", "rejected"} {
+		t.Run(status, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := newTestClient(t, s)
+			admin.login("admin@templepoints.org", "admin123")
+			sub := submitUnitemized(t, s, 1, 4)
+			points, pending := wardTotals(t, s, 1)
+
+			// Partly approved, so the reversal must take off what was awarded
+			if rec := admin.do("POST", pointsPath(sub.ID, "approve"),
+				map[string]interface{}{"points": 3, "note": "One was a duplicate"}); rec.Code != http.StatusOK {
+				t.Fatalf("approve: %d %s", rec.Code, rec.Body.String())
+			}
+
+			body := map[string]interface{}{"status": status, "reason": "Counted last week"}
+			if rec := admin.do("POST", pointsPath(sub.ID, "reverse"), body); rec.Code != http.StatusOK {
+				t.Fatalf("reverse: %d %s", rec.Code, rec.Body.String())
+			}
+
+			wantPending := pending - sub.Points
+			if status == "pending" {
+				wantPending = pending
+			}
+			if gotPoints, gotPending := wardTotals(t, s, 1); gotPoints != points || gotPending != wantPending {
+				t.Errorf("ward totals = %d, %d; want %d, %d", gotPoints, gotPending, points, wantPending)
+			}
+
+			var gotStatus, reason string
+			var awarded *int
+			s.db.QueryRow(`SELECT status, reversal_reason, awarded_points FROM point_submissions WHERE id = ?`,
+				sub.ID).Scan(&gotStatus, &reason, &awarded)
+			if gotStatus != status || reason != "Counted last week" || awarded != nil {
+				t.Errorf("submission is %s, reason %q, awarded %v", gotStatus, reason, awarded)
+			}
+
+			if rec := admin.do("POST", pointsPath(sub.ID, "reverse"), body); rec.Code != http.StatusConflict {
+				t.Errorf("reversed twice: status %d, want %d", rec.Code, http.StatusConflict)
+			}
+		})
+	}
+}
+
+func TestReverseApprovalChecks(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	sub := submitPoints(t, s, 1, 2)
+	if rec := admin.do("POST", pointsPath(sub.ID, "approve"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body.String())
+	}
+	pending := submitPoints(t, s, 1, 2)
+
+	createTestUser(t, s, "approver@example.org", "ward_approver", 2)
+	otherWard := newTestClient(t, s)
+	otherWard.login("approver@example.org", testPassword)
+
+	tests := []struct {
+		name   string
+		client *testClient
+		id     int
+		body   map[string]interface{}
+		want   int
+	}{
+		{"no reason", admin, sub.ID, map[string]interface{}{"status": "pending", "reason": "  "}, http.StatusBadRequest},
+		{"unknown status", admin, sub.ID, map[string]interface{}{"status": "approved", "reason": "Oops"}, http.StatusBadRequest},
+		{"approver for another ward", otherWard, sub.ID, map[string]interface{}{"status": "pending", "reason": "Oops"}, http.StatusForbidden},
+		{"not approved", admin, pending.ID, map[string]interface{}{"status": "rejected", "reason": "Oops"}, http.StatusConflict},
+		{"signed out", newTestClient(t, s), sub.ID, map[string]interface{}{"status": "pending", "reason": "Oops"}, http.StatusUnauthorized},
+	}
+
+	points, _ := wardTotals(t, s, 1)
+	for _, tt := range tests {
+		if rec := tt.client.do("POST", pointsPath(tt.id, "reverse"), tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+	if got, _ := wardTotals(t, s, 1); got != points {
+		t.Errorf("ward points changed from %d to %d", points, got)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionDuration   = 24 * time.Hour
+)
+
+// loadSessionSecret returns the key used to sign session cookies. It comes
+// from SESSION_SECRET when set, otherwise a random key is generated once and
+// kept in the settings table so sessions survive restarts.
+func loadSessionSecret(db *sql.DB) ([]byte, error) {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+
+	stored, err := getSetting(db, "session_secret")
+	if err == nil {
+		return hex.DecodeString(stored)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := setSetting(db, "session_secret", hex.EncodeToString(secret)); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// generateToken returns a random URL-safe token with n bytes of entropy.
+func generateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how opaque tokens are stored at rest.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) signValue(value string) string {
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedValue checks the HMAC on a value produced by signValue and
+// returns the original value.
+func (s *Server) verifySignedValue(signed string) (string, bool) {
+	idx := strings.LastIndex(signed, ".")
+	if idx <= 0 {
+		return "", false
+	}
+
+	value := signed[:idx]
+	if !hmac.Equal([]byte(s.signValue(value)), []byte(signed)) {
+		return "", false
+	}
+
+	return value, true
+}
+
+// clientIP returns the address of the client making the request. When the
+// direct peer is a loopback or private address (our Caddy proxy), the last
+// hop recorded in X-Forwarded-For is used instead.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !(peer.IsLoopback() || peer.IsPrivate()) {
+		return host
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" {
+		return host
+	}
+
+	hops := strings.Split(forwarded, ",")
+	if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// createSession stores a new session for the user and sets the signed
+// session cookie on the response. A twoFactorPending session can only be used
+// to enroll in two-factor authentication.
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request, userID int, twoFactorPending bool) error {
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO sessions (user_id, token_hash, ip_address, user_agent, expires_at, two_factor_pending)
+		VALUES (?, ?, ?, ?, datetime('now', ?), ?)
+	`, userID, hashToken(token), clientIP(r), r.UserAgent(),
+		fmt.Sprintf("+%d seconds", int(sessionDuration.Seconds())), twoFactorPending)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.signValue(token),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(sessionDuration.Seconds()),
+	})
+
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+}
+
+// sessionTokenFromRequest returns the raw session token if the cookie is
+// present and correctly signed.
+func (s *Server) sessionTokenFromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	return s.verifySignedValue(cookie.Value)
+}
+
+// getSession resolves the request's cookie to an unexpired session belonging
+// to an enabled user, touching its last-seen time. It returns nil if there is
+// no valid session. If the user's role has come to require 2FA since they
+// signed in and they haven't enrolled, the session is treated as
+// TwoFactorPending.
+func (s *Server) getSession(r *http.Request) *Session {
+	token, ok := s.sessionTokenFromRequest(r)
+	if !ok {
+		return nil
+	}
+
+	var session Session
+	var role string
+	var totpEnabled bool
+	err := s.db.QueryRow(`
+		SELECT s.id, s.user_id, s.ip_address, s.user_agent, s.created_at, s.last_seen_at,
+		       s.expires_at, s.two_factor_pending, u.role, u.totp_enabled
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.token_hash = ? AND s.expires_at > CURRENT_TIMESTAMP AND u.disabled = 0
+	`, hashToken(token)).Scan(&session.ID, &session.UserID, &session.IPAddress,
+		&session.UserAgent, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt,
+		&session.TwoFactorPending, &role, &totpEnabled)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading session: %v", err)
+		}
+		return nil
+	}
+
+	if !totpEnabled && s.twoFactorRequired(role) {
+		session.TwoFactorPending = true
+	}
+
+	// Only write last-seen once a minute so every request isn't a write
+	_, err = s.db.Exec(`
+		UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND last_seen_at < datetime('now', '-1 minute')
+	`, session.ID)
+	if err != nil {
+		log.Printf("Error updating session last seen: %v", err)
+	}
+
+	return &session
+}
+
+func (s *Server) revokeSession(sessionID int) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, sessionID)
+	return err
+}
+
+// revokeUserSessions removes every session belonging to the user except
+// keepSessionID (pass 0 to revoke them all). It returns how many were removed.
+func (s *Server) revokeUserSessions(userID, keepSessionID int) (int64, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM sessions WHERE user_id = ? AND id != ?
+	`, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// List the current user's active sessions
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	current := s.getSession(r)
+	if current == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, user_id, ip_address, user_agent, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_seen_at DESC
+	`, current.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error querying sessions: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserID, &session.IPAddress, &session.UserAgent,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+		if err != nil {
+			log.Printf("Error scanning session: %v", err)
+			continue
+		}
+		session.Current = session.ID == current.ID
+		sessions = append(sessions, session)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Revoke one of the current user's sessions
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	current := s.getSession(r)
+	if current == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	// Scope the delete to the caller so users can't revoke each other's sessions
+	result, err := s.db.Exec(`
+		DELETE FROM sessions WHERE id = ? AND user_id = ?
+	`, sessionID, current.UserID)
+	if err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		log.Printf("Error revoking session: %v", err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if sessionID == current.ID {
+		clearSessionCookie(w)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Session revoked",
+	})
+}
+
+// Revoke every session for the current user except the one making the request
+func (s *Server) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	current := s.getSession(r)
+	if current == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	revoked, err := s.revokeUserSessions(current.UserID, current.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		log.Printf("Error revoking sessions: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"revoked": revoked,
+		"message": fmt.Sprintf("Signed out of %d other session(s)", revoked),
+	})
+}
+
+// Force-logout a user everywhere (admin only)
+func (s *Server) handleForceLogout(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	targetID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, targetID).Scan(&exists)
+	if err != nil || !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Sessions and API tokens go together so a leaked token can't outlive
+	// the logout
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, targetID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		log.Printf("Error revoking sessions: %v", err)
+		return
+	}
+	revoked, _ := result.RowsAffected()
+
+	revokedTokens, err := revokeUserAPITokens(tx, targetID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		log.Printf("Error revoking API tokens: %v", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"revoked":        revoked,
+		"revoked_tokens": revokedTokens,
+	})
+}
+
+// cleanupSessions periodically removes expired sessions.
+func (s *Server) cleanupSessions() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= CURRENT_TIMESTAMP`); err != nil {
+			log.Printf("Error cleaning up sessions: %v", err)
+		}
+		if _, err := s.db.Exec(`DELETE FROM oidc_used_tokens WHERE expires_at <= CURRENT_TIMESTAMP`); err != nil {
+			log.Printf("Error cleaning up OIDC tokens: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerifySignedValue(t *testing.T) {
+	s := &Server{sessionSecret: []byte("test session secret")}
+	other := &Server{sessionSecret: []byte("another secret")}
+
+	signed := s.signValue("state.with.dots")
+	value, mac := signed[:strings.LastIndex(signed, ".")], signed[strings.LastIndex(signed, ".")+1:]
+
+	tests := []struct {
+		name   string
+		signed string
+		want   string
+		ok     bool
+	}{
+		{"valid", signed, "state.with.dots", true},
+		{"empty value", s.signValue(""), "", false},
+		{"tampered value", "state.with.dotz." + mac, "", false},
+		{"tampered signature", value + "." + strings.Repeat("A", len(mac)), "", false},
+		{"missing signature", value + ".", "", false},
+		{"no separator", "nosignature", "", false},
+		{"empty", "", "", false},
+		{"other secret", other.signValue("state.with.dots"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.verifySignedValue(tt.signed)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("verifySignedValue(%q) = %q, %v; want %q, %v", tt.signed, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	c.login("admin@templepoints.org", "admin123")
+
+	if rec := c.do("GET", "/api/user", nil); rec.Code != http.StatusOK {
+		t.Fatalf("signed in user: %d %s", rec.Code, rec.Body.String())
+	}
+
+	session := c.cookies[sessionCookieName]
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"raw user ID", "1"},
+		{"unsigned token", session.Value[:strings.LastIndex(session.Value, ".")]},
+		{"token signed with another secret",
+			(&Server{sessionSecret: []byte("another secret")}).signValue("forged")},
+		{"signed token with no session", s.signValue("forged")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forged := newTestClient(t, s)
+			forged.cookies[sessionCookieName] = &http.Cookie{Name: sessionCookieName, Value: tt.value}
+			if rec := forged.do("GET", "/api/user", nil); rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+
+	if rec := c.do("POST", "/api/logout", nil); rec.Code != http.StatusOK {
+		t.Fatalf("logout: %d %s", rec.Code, rec.Body.String())
+	}
+	replayed := newTestClient(t, s)
+	replayed.cookies[sessionCookieName] = session
+	if rec := replayed.do("GET", "/api/user", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session still valid after logout: %d", rec.Code)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Failures older than this are forgotten
+	loginFailureWindow = time.Hour
+
+	// After this many failures each further attempt has to wait
+	// loginBackoffBase * 2^(failures - loginBackoffAfter), up to loginBackoffMax
+	loginBackoffAfter = 3
+	loginBackoffBase  = time.Second
+	loginBackoffMax   = 5 * time.Minute
+
+	accountLockoutThreshold = 10
+	ipLockoutThreshold      = 50
+	loginLockoutDuration    = 30 * time.Minute
+)
+
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func loginBackoff(failures int) time.Duration {
+	if failures < loginBackoffAfter {
+		return 0
+	}
+
+	shift := failures - loginBackoffAfter
+	if shift > 16 {
+		return loginBackoffMax
+	}
+
+	delay := loginBackoffBase << uint(shift)
+	if delay > loginBackoffMax {
+		return loginBackoffMax
+	}
+	return delay
+}
+
+// loginRetryAfter returns how long the caller has to wait before another
+// login attempt for the given throttle key is allowed.
+func (s *Server) loginRetryAfter(key string) time.Duration {
+	var failures int
+	var lastFailure time.Time
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT failures, last_failure_at, locked_until
+		FROM login_throttles
+		WHERE key = ?
+	`, key).Scan(&failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error reading login throttle: %v", err)
+		}
+		return 0
+	}
+
+	now := time.Now()
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		return lockedUntil.Time.Sub(now)
+	}
+
+	if now.Sub(lastFailure) > loginFailureWindow {
+		return 0
+	}
+
+	if wait := lastFailure.Add(loginBackoff(failures)).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// recordLoginFailure bumps the failure count for key and locks it once the
+// threshold is reached. It reports whether this failure caused a lockout.
+// The count is incremented in SQL so concurrent failures can't overwrite each
+// other and stay under the threshold. Locking starts the count again, so once
+// a lockout expires it takes a full threshold of failures to lock it again.
+func (s *Server) recordLoginFailure(key string, lockThreshold int) bool {
+	now := time.Now().UTC()
+
+	var failures int
+	err := s.db.QueryRow(`
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1
+				ELSE login_throttles.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING failures
+	`, key, now, now.Add(-loginFailureWindow)).Scan(&failures)
+	if err != nil {
+		log.Printf("Error recording login failure: %v", err)
+		return false
+	}
+
+	if failures < lockThreshold {
+		return false
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE login_throttles SET locked_until = ?, failures = 0 WHERE key = ?
+	`, now.Add(loginLockoutDuration), key)
+	if err != nil {
+		log.Printf("Error locking login: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) clearLoginFailures(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_throttles WHERE key = ?`, key)
+	return err
+}
+
+// checkLoginThrottle writes a 429 and returns false if either the account or
+// the client IP is currently backing off or locked out.
+func (s *Server) checkLoginThrottle(w http.ResponseWriter, email, ip string) bool {
+	wait := s.loginRetryAfter(emailThrottleKey(email))
+	if ipWait := s.loginRetryAfter(ipThrottleKey(ip)); ipWait > wait {
+		wait = ipWait
+	}
+
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed login attempts. Try again in %d seconds.", seconds),
+		http.StatusTooManyRequests)
+	return false
+}
+
+// handleLoginFailure records a failed attempt against both the account and
+// the client IP, logging any lockout it triggers.
+func (s *Server) handleLoginFailure(email, ip string) {
+	if s.recordLoginFailure(emailThrottleKey(email), accountLockoutThreshold) {
+		var userID sql.NullInt64
+		s.db.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&userID)
+
+		var user *int
+		wardID := 0
+		if userID.Valid {
+			id := int(userID.Int64)
+			user = &id
+			wardID = s.logWardForUser(id)
+		}
+		s.logActivity(wardID, user, "account_locked",
+			fmt.Sprintf("Locked %s for %s after %d failed logins from %s",
+				email, loginLockoutDuration, accountLockoutThreshold, ip), 0)
+	}
+
+	if s.recordLoginFailure(ipThrottleKey(ip), ipLockoutThreshold) {
+		s.logActivity(0, nil, "ip_locked",
+			fmt.Sprintf("Locked %s for %s after %d failed logins", ip,
+				loginLockoutDuration, ipLockoutThreshold), 0)
+	}
+}
+
+// Unlock a locked-out account (admin only)
+func (s *Server) handleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	targetID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	err = s.db.QueryRow(`SELECT email FROM users WHERE id = ?`, targetID).Scan(&email)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.clearLoginFailures(emailThrottleKey(email)); err != nil {
+		http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+		log.Printf("Error unlocking account: %v", err)
+		return
+	}
+
+	s.logActivity(s.logWardForUser(targetID), &userID, "account_unlocked",
+		fmt.Sprintf("Unlocked %s", email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("%s can sign in again", email),
+	})
+}
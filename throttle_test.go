@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{loginBackoffAfter - 1, 0},
+		{loginBackoffAfter, loginBackoffBase},
+		{loginBackoffAfter + 1, 2 * loginBackoffBase},
+		{loginBackoffAfter + 3, 8 * loginBackoffBase},
+		{loginBackoffAfter + 16, loginBackoffMax},
+		{loginBackoffAfter + 100, loginBackoffMax},
+	}
+
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	s := newTestServer(t)
+	key := emailThrottleKey("admin@templepoints.org")
+
+	for i := 1; i < accountLockoutThreshold; i++ {
+		if s.recordLoginFailure(key, accountLockoutThreshold) {
+			t.Fatalf("locked after %d failures", i)
+		}
+	}
+	if !s.recordLoginFailure(key, accountLockoutThreshold) {
+		t.Fatalf("not locked after %d failures", accountLockoutThreshold)
+	}
+	if wait := s.loginRetryAfter(key); wait <= loginBackoffMax {
+		t.Errorf("retry after %s while locked, want about %s", wait, loginLockoutDuration)
+	}
+
+	// Let the lockout expire without waiting for it
+	_, err := s.db.Exec(`UPDATE login_throttles SET locked_until = ?, last_failure_at = ? WHERE key = ?`,
+		time.Now().UTC().Add(-time.Second), time.Now().UTC().Add(-time.Second), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait := s.loginRetryAfter(key); wait != 0 {
+		t.Fatalf("retry after %s once the lockout expired", wait)
+	}
+
+	if s.recordLoginFailure(key, accountLockoutThreshold) {
+		t.Fatal("a single failure after the lockout expired locked the account again")
+	}
+	if wait := s.loginRetryAfter(key); wait != 0 {
+		t.Errorf("retry after %s after one failure, want no wait", wait)
+	}
+}
+
+func TestLoginRefusedWhileLocked(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	wrong := map[string]string{"email": "admin@templepoints.org", "password": "wrong"}
+
+	// Skip the backoff between attempts so the test reaches the lockout
+	throttled := 0
+	for i := 0; i < accountLockoutThreshold; i++ {
+		if _, err := s.db.Exec(`UPDATE login_throttles SET last_failure_at = ?`,
+			time.Now().UTC().Add(-loginBackoffMax)); err != nil {
+			t.Fatal(err)
+		}
+		if rec := c.do("POST", "/api/login", wrong); rec.Code == http.StatusTooManyRequests {
+			throttled++
+		}
+	}
+	if throttled != 0 {
+		t.Fatalf("%d attempts were throttled before the lockout", throttled)
+	}
+
+	rec := c.do("POST", "/api/login", map[string]string{"email": "admin@templepoints.org", "password": "admin123"})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("correct password while locked: status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+
+	var locked int
+	s.db.QueryRow(`SELECT COUNT(*) FROM activity_logs WHERE action = 'account_locked'`).Scan(&locked)
+	if locked != 1 {
+		t.Errorf("%d account_locked log entries, want 1", locked)
+	}
+}
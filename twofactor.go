@@ -0,0 +1,693 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpIssuer = "Temple Points"
+	totpPeriod = 30
+	totpDigits = 6
+
+	// Accept codes from one step either side to allow for clock drift
+	totpSkew = 1
+
+	twoFactorChallengeTTL = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the RFC 6238 code for a time step (RFC 4226 HOTP with
+// HMAC-SHA1).
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// verifyTOTP checks code against the secret around the current time and
+// returns the matching time step. Steps at or before lastCounter are refused
+// so a code can't be replayed.
+func verifyTOTP(secret, code string, lastCounter int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastCounter {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpProvisioningURI builds the otpauth:// URI that authenticator apps read
+// from a QR code.
+func totpProvisioningURI(email, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func twoFactorSettingKey(role string) string {
+	return "require_2fa:" + role
+}
+
+// twoFactorRequired reports whether an admin has made 2FA mandatory for role.
+func (s *Server) twoFactorRequired(role string) bool {
+	value, err := getSetting(s.db, twoFactorSettingKey(role))
+	return err == nil && value == "true"
+}
+
+// newTwoFactorChallenge returns a signed, short-lived token proving the
+// user has passed the password step.
+func (s *Server) newTwoFactorChallenge(userID int) string {
+	expires := time.Now().Add(twoFactorChallengeTTL).Unix()
+	return s.signValue(fmt.Sprintf("2fa:%d:%d", userID, expires))
+}
+
+func (s *Server) parseTwoFactorChallenge(challenge string) (int, bool) {
+	value, ok := s.verifySignedValue(challenge)
+	if !ok {
+		return 0, false
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || parts[0] != "2fa" {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code for the user, consuming whichever one matched.
+func (s *Server) checkSecondFactor(userID int, code string) bool {
+	var secret sql.NullString
+	var lastCounter int64
+	err := s.db.QueryRow(`
+		SELECT totp_secret, totp_last_counter FROM users WHERE id = ? AND totp_enabled = 1
+	`, userID).Scan(&secret, &lastCounter)
+	if err != nil || !secret.Valid {
+		return false
+	}
+
+	if step, ok := verifyTOTP(secret.String, code, lastCounter); ok {
+		// Only the first request to record this step wins
+		result, err := s.db.Exec(`
+			UPDATE users SET totp_last_counter = ? WHERE id = ? AND totp_last_counter < ?
+		`, step, userID, step)
+		if err != nil {
+			log.Printf("Error recording TOTP step: %v", err)
+			return false
+		}
+		affected, _ := result.RowsAffected()
+		return affected == 1
+	}
+
+	return s.useRecoveryCode(userID, code)
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func (s *Server) useRecoveryCode(userID int, code string) bool {
+	result, err := s.db.Exec(`
+		UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		log.Printf("Error using recovery code: %v", err)
+		return false
+	}
+
+	affected, _ := result.RowsAffected()
+	return affected == 1
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new
+// plaintext codes. Only hashes are kept.
+func (s *Server) generateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+
+		_, err := tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)
+		`, userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, tx.Commit()
+}
+
+// Complete a login that requires a second factor
+func (s *Server) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := s.parseTwoFactorChallenge(req.Challenge)
+	if !ok {
+		http.Error(w, "Login expired, please sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	err := s.db.QueryRow(`
+		SELECT id, email, role, totp_enabled FROM users WHERE id = ? AND disabled = 0
+	`, userID).Scan(&user.ID, &user.Email, &user.Role, &user.TwoFactorEnabled)
+	if err != nil {
+		http.Error(w, "Login expired, please sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are short, so guessing them counts against the same throttle
+	ip := clientIP(r)
+	if !s.checkLoginThrottle(w, user.Email, ip) {
+		return
+	}
+
+	if !s.checkSecondFactor(user.ID, req.Code) {
+		s.handleLoginFailure(user.Email, ip)
+		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.clearLoginFailures(emailThrottleKey(user.Email)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	if err := s.createSession(w, r, user.ID, false); err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"user":    user,
+	})
+}
+
+// Two-factor status for the current user
+func (s *Server) handleTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var role string
+	var enabled bool
+	err := s.db.QueryRow(`
+		SELECT role, totp_enabled FROM users WHERE id = ?
+	`, session.UserID).Scan(&role, &enabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var remaining int
+	s.db.QueryRow(`
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL
+	`, session.UserID).Scan(&remaining)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  enabled,
+		"required":                 s.twoFactorRequired(role),
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// Start 2FA enrollment by generating a new secret. Sessions that are pending
+// enrollment may use this.
+func (s *Server) handleTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	var enabled bool
+	err := s.db.QueryRow(`
+		SELECT email, totp_enabled FROM users WHERE id = ?
+	`, session.UserID).Scan(&email, &enabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE users SET totp_secret = ?, totp_last_counter = 0 WHERE id = ?
+	`, secret, session.UserID)
+	if err != nil {
+		log.Printf("Error saving TOTP secret: %v", err)
+		http.Error(w, "Failed to start setup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(email, secret),
+	})
+}
+
+// Confirm enrollment with a code from the authenticator app
+func (s *Server) handleTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	var email string
+	err := s.db.QueryRow(`
+		SELECT email, totp_secret, totp_enabled FROM users WHERE id = ?
+	`, session.UserID).Scan(&email, &secret, &enabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if !secret.Valid {
+		http.Error(w, "Start setup first", http.StatusBadRequest)
+		return
+	}
+
+	// Guessing codes with a stolen session counts against the login throttle
+	ip := clientIP(r)
+	if !s.checkLoginThrottle(w, email, ip) {
+		return
+	}
+
+	step, ok := verifyTOTP(secret.String, req.Code, 0)
+	if !ok {
+		s.handleLoginFailure(email, ip)
+		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.clearLoginFailures(emailThrottleKey(email)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE users SET totp_enabled = 1, totp_last_counter = ? WHERE id = ?
+	`, step, session.UserID)
+	if err != nil {
+		log.Printf("Error enabling 2FA: %v", err)
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := s.generateRecoveryCodes(session.UserID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	// The session that just enrolled is now a full session
+	_, err = s.db.Exec(`UPDATE sessions SET two_factor_pending = 0 WHERE id = ?`, session.ID)
+	if err != nil {
+		log.Printf("Error upgrading session: %v", err)
+	}
+
+	userID := session.UserID
+	s.logActivity(s.logWardForUser(userID), &userID, "2fa_enabled",
+		fmt.Sprintf("%s enabled two-factor authentication", email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// Turn 2FA off for the current user (requires their password)
+func (s *Server) handleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var email, role, hashedPassword string
+	err := s.db.QueryRow(`
+		SELECT email, role, password FROM users WHERE id = ?
+	`, userID).Scan(&email, &role, &hashedPassword)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ip := clientIP(r)
+	if !s.checkLoginThrottle(w, email, ip) {
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
+		s.handleLoginFailure(email, ip)
+		http.Error(w, "Incorrect password", http.StatusUnauthorized)
+		return
+	}
+
+	if s.twoFactorRequired(role) {
+		http.Error(w, "Two-factor authentication is required for your role", http.StatusForbidden)
+		return
+	}
+
+	if err := s.clearTwoFactor(userID); err != nil {
+		log.Printf("Error disabling 2FA: %v", err)
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(s.logWardForUser(userID), &userID, "2fa_disabled",
+		fmt.Sprintf("%s disabled two-factor authentication", email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+func (s *Server) clearTwoFactor(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_counter = 0 WHERE id = ?
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replace the current user's recovery codes
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	if err := s.db.QueryRow(`SELECT email FROM users WHERE id = ?`, userID).Scan(&email); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Guessing codes with a stolen session counts against the login throttle
+	ip := clientIP(r)
+	if !s.checkLoginThrottle(w, email, ip) {
+		return
+	}
+
+	if !s.checkSecondFactor(userID, req.Code) {
+		s.handleLoginFailure(email, ip)
+		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.clearLoginFailures(emailThrottleKey(email)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	codes, err := s.generateRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// Reset a user's 2FA after they lose their device (admin only)
+func (s *Server) handleResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	targetID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	err = s.db.QueryRow(`SELECT email FROM users WHERE id = ?`, targetID).Scan(&email)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.clearTwoFactor(targetID); err != nil {
+		log.Printf("Error resetting 2FA: %v", err)
+		http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever holds the lost device may also hold a session
+	if _, err := s.revokeUserSessions(targetID, 0); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+	}
+
+	s.logActivity(s.logWardForUser(targetID), &userID, "2fa_reset",
+		fmt.Sprintf("Reset two-factor authentication for %s", email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Two-factor authentication reset for %s", email),
+	})
+}
+
+// Get or set which roles must use 2FA (admin only)
+func (s *Server) handleTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			RequiredRoles []string `json:"required_roles"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		required := map[string]bool{}
+		for _, role := range req.RequiredRoles {
+			if !isValidRole(role) {
+				http.Error(w, fmt.Sprintf("Invalid role %q", role), http.StatusBadRequest)
+				return
+			}
+			required[role] = true
+		}
+
+		for _, role := range userRoles {
+			if err := setSetting(s.db, twoFactorSettingKey(role), strconv.FormatBool(required[role])); err != nil {
+				log.Printf("Error saving 2FA policy: %v", err)
+				http.Error(w, "Failed to save policy", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		s.logActivity(0, &userID, "2fa_policy_changed",
+			fmt.Sprintf("Two-factor required for: %s", strings.Join(req.RequiredRoles, ", ")), 0)
+	}
+
+	requiredRoles := []string{}
+	for _, role := range userRoles {
+		if s.twoFactorRequired(role) {
+			requiredRoles = append(requiredRoles, role)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"required_roles": requiredRoles,
+	})
+}
+
+func isValidRole(role string) bool {
+	for _, r := range userRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base32"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key from the RFC 6238 test vectors.
+var rfc6238Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("totpCode accepted an invalid secret")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Now().Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	current := code(now)
+
+	tests := []struct {
+		name        string
+		code        string
+		lastCounter int64
+		wantStep    int64
+		ok          bool
+	}{
+		{"current step", current, 0, now, true},
+		{"previous step", code(now - totpSkew), 0, now - totpSkew, true},
+		{"next step", code(now + totpSkew), 0, now + totpSkew, true},
+		{"spaces", " " + current[:3] + " " + current[3:] + " ", 0, now, true},
+		{"too old", code(now - totpSkew - 1), 0, 0, false},
+		{"too far ahead", code(now + totpSkew + 1), 0, 0, false},
+		{"replayed step", current, now, 0, false},
+		{"later step already used", code(now - 1), now - 1, 0, false},
+		{"too short", current[:totpDigits-1], 0, 0, false},
+		{"too long", current + "0", 0, 0, false},
+		{"empty", "", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := verifyTOTP(rfc6238Secret, tt.code, tt.lastCounter)
+			if ok != tt.ok || step != tt.wantStep {
+				t.Errorf("verifyTOTP(%q, %d) = %d, %v; want %d, %v", tt.code, tt.lastCounter, step, ok,
+					tt.wantStep, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckSecondFactorIsSingleUse(t *testing.T) {
+	s := newTestServer(t)
+	const userID = 1
+
+	if _, err := s.db.Exec(`UPDATE users SET totp_secret = ?, totp_enabled = 1 WHERE id = ?`,
+		rfc6238Secret, userID); err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := s.generateRecoveryCodes(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totpCode(rfc6238Secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"fresh code", code, true},
+		{"same code again", code, false},
+		{"recovery code", recovery[0], true},
+		{"recovery code again", recovery[0], false},
+		{"wrong code", "000000x", false},
+	}
+
+	for _, step := range steps {
+		if got := s.checkSecondFactor(userID, step.code); got != step.ok {
+			t.Errorf("%s: checkSecondFactor = %v, want %v", step.name, got, step.ok)
+		}
+	}
+}
+
+func TestTwoFactorPolicyAppliesToOpenSessions(t *testing.T) {
+	s := newTestServer(t)
+	createTestUser(t, s, "approver@example.org", "ward_approver", 1)
+
+	approver := newTestClient(t, s)
+	approver.login("approver@example.org", testPassword)
+
+	rec := approver.do("POST", "/api/tokens", map[string]interface{}{
+		"name": "script", "scopes": []string{permViewSubmissions},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("creating token: %d %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, rec, &created)
+
+	script := newTestClient(t, s)
+	script.headers["Authorization"] = "Bearer " + created.Token
+
+	admin := newTestClient(t, s)
+	admin.login("admin@templepoints.org", "admin123")
+	rec = admin.do("POST", "/api/settings/2fa", map[string]interface{}{"required_roles": []string{"ward_approver"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("setting policy: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := approver.do("GET", "/api/user", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("open session after 2FA became required: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	var status struct {
+		TwoFactorSetupRequired bool `json:"twoFactorSetupRequired"`
+	}
+	decodeJSON(t, approver.do("GET", "/api/auth/status", nil), &status)
+	if !status.TwoFactorSetupRequired {
+		t.Error("auth status doesn't ask the open session to set up 2FA")
+	}
+	if rec := script.do("GET", "/api/submissions", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("API token after 2FA became required: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := admin.do("GET", "/api/user", nil); rec.Code != http.StatusOK {
+		t.Errorf("session of a role without the requirement: status %d", rec.Code)
+	}
+
+	// Enrolling from the restricted session restores both
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	decodeJSON(t, approver.do("POST", "/api/2fa/setup", nil), &setup)
+	code, err := totpCode(setup.Secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := approver.do("POST", "/api/2fa/enable", map[string]string{"code": code}); rec.Code != http.StatusOK {
+		t.Fatalf("enabling 2FA: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := approver.do("GET", "/api/user", nil); rec.Code != http.StatusOK {
+		t.Errorf("session after enrolling: status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := script.do("GET", "/api/submissions", nil); rec.Code != http.StatusOK {
+		t.Errorf("API token after enrolling: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const userColumns = `id, email, role, disabled, totp_enabled, created_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }, user *User) error {
+	return row.Scan(&user.ID, &user.Email, &user.Role, &user.Disabled, &user.TwoFactorEnabled,
+		&user.CreatedAt)
+}
+
+func (s *Server) loadUser(userID int) (*User, error) {
+	var user User
+	err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID), &user)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{user}
+	if err := s.attachWards(users); err != nil {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+// attachWards fills in each user's ward memberships.
+func (s *Server) attachWards(users []User) error {
+	byID := make(map[int]*User, len(users))
+	for i := range users {
+		users[i].Wards = []WardRef{}
+		byID[users[i].ID] = &users[i]
+	}
+
+	rows, err := s.db.Query(`
+		SELECT uw.user_id, w.id, w.name
+		FROM user_wards uw
+		JOIN wards w ON uw.ward_id = w.id
+		ORDER BY w.name
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		var ward WardRef
+		if err := rows.Scan(&userID, &ward.ID, &ward.Name); err != nil {
+			return err
+		}
+		if user, ok := byID[userID]; ok {
+			user.Wards = append(user.Wards, ward)
+		}
+	}
+	return rows.Err()
+}
+
+func wardNames(wards []WardRef) string {
+	names := make([]string, len(wards))
+	for i, ward := range wards {
+		names[i] = ward.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// lastAdminCheck is called inside a transaction after a change that could
+// remove an admin. If no enabled admin would remain it writes a 409 and
+// returns false so the caller rolls back.
+func lastAdminCheck(w http.ResponseWriter, tx *sql.Tx, message string) bool {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = 'admin' AND disabled = 0`).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting admins: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+
+	if count == 0 {
+		http.Error(w, message, http.StatusConflict)
+		return false
+	}
+
+	return true
+}
+
+// targetUser checks that the caller is an admin and loads the user named in
+// the URL. It writes an error and returns nil if either fails.
+func (s *Server) targetUser(w http.ResponseWriter, r *http.Request) (int, *User) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, nil
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return 0, nil
+	}
+
+	targetID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, nil
+	}
+
+	target, err := s.loadUser(targetID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, nil
+	}
+
+	return userID, target
+}
+
+// List every user account (admin only)
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromSession(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+		return
+	}
+
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY disabled, role, email`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error querying users: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			log.Printf("Error scanning user: %v", err)
+			continue
+		}
+		users = append(users, user)
+	}
+
+	if err := s.attachWards(users); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error loading user wards: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// Change a user's email, role or wards (admin only)
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userID, target := s.targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	var req struct {
+		Email   string `json:"email"`
+		Role    string `json:"role"`
+		WardIDs []int  `json:"ward_ids"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || req.Role == "" {
+		http.Error(w, "Email and role are required", http.StatusBadRequest)
+		return
+	}
+
+	wardIDs, msg := validateRoleAssignment(req.Role, req.WardIDs)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET email = ?, role = ? WHERE id = ?
+	`, req.Email, req.Role, target.ID)
+	if err == nil {
+		err = setUserWards(tx, target.ID, wardIDs)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint") {
+			http.Error(w, "Email already exists", http.StatusConflict)
+		} else if strings.Contains(err.Error(), "FOREIGN KEY constraint") {
+			http.Error(w, "Ward not found", http.StatusBadRequest)
+		} else {
+			log.Printf("Error updating user: %v", err)
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !lastAdminCheck(w, tx, "Can't demote the last admin") {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := s.loadUser(target.ID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var changes []string
+	if updated.Email != target.Email {
+		changes = append(changes, fmt.Sprintf("email %s → %s", target.Email, updated.Email))
+	}
+	if updated.Role != target.Role {
+		changes = append(changes, fmt.Sprintf("role %s → %s", target.Role, updated.Role))
+	}
+	if before, after := wardNames(target.Wards), wardNames(updated.Wards); before != after {
+		changes = append(changes, fmt.Sprintf("wards %q → %q", before, after))
+	}
+	if len(changes) > 0 {
+		s.logActivity(logWard(wardRefIDs(updated.Wards)), &userID, "user_updated",
+			fmt.Sprintf("Updated %s: %s", updated.Email, strings.Join(changes, ", ")), 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("%s updated", updated.Email),
+		"user":    updated,
+	})
+}
+
+// Disable a user (admin only). They are signed out everywhere and can't sign
+// in again until re-enabled.
+func (s *Server) handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	s.setUserDisabled(w, r, true)
+}
+
+// Re-enable a disabled user (admin only)
+func (s *Server) handleEnableUser(w http.ResponseWriter, r *http.Request) {
+	s.setUserDisabled(w, r, false)
+}
+
+func (s *Server) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	userID, target := s.targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	if disabled && target.ID == userID {
+		http.Error(w, "You can't disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET disabled = ? WHERE id = ?`, disabled, target.ID); err != nil {
+		log.Printf("Error updating user: %v", err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if disabled {
+		if !lastAdminCheck(w, tx, "Can't disable the last admin") {
+			return
+		}
+
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, target.ID); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+
+		// Re-enabling the account mustn't bring old tokens back to life
+		if _, err := revokeUserAPITokens(tx, target.ID); err != nil {
+			log.Printf("Error revoking API tokens: %v", err)
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if disabled {
+		s.logActivity(logWard(wardRefIDs(target.Wards)), &userID, "user_disabled",
+			fmt.Sprintf("Disabled %s", target.Email), 0)
+	} else {
+		s.logActivity(logWard(wardRefIDs(target.Wards)), &userID, "user_enabled",
+			fmt.Sprintf("Re-enabled %s", target.Email), 0)
+	}
+
+	message := fmt.Sprintf("%s can sign in again", target.Email)
+	if disabled {
+		message = fmt.Sprintf("%s has been disabled", target.Email)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": message,
+	})
+}
+
+// Delete a user (admin only). Their past approvals and activity are kept but
+// no longer point at an account.
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, target := s.targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	if target.ID == userID {
+		http.Error(w, "You can't delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`UPDATE point_submissions SET approved_by = NULL WHERE approved_by = ?`,
+		`UPDATE point_submissions SET submitted_by = NULL WHERE submitted_by = ?`,
+		`UPDATE point_submissions SET reversed_by = NULL WHERE reversed_by = ?`,
+		`UPDATE submission_comments SET user_id = NULL WHERE user_id = ?`,
+		`UPDATE activity_logs SET user_id = NULL WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, target.ID); err != nil {
+			log.Printf("Error deleting user: %v", err)
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !lastAdminCheck(w, tx, "Can't delete the last admin") {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	s.logActivity(logWard(wardRefIDs(target.Wards)), &userID, "user_deleted",
+		fmt.Sprintf("Deleted %s: %s", target.Role, target.Email), 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("%s has been deleted", target.Email),
+	})
+}